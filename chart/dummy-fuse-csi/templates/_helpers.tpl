@@ -37,3 +37,31 @@ Create node plugin DaemonSet name.
 {{- define "dummy-fuse-csi.name.nodeplugin" -}}
 {{- printf "%s" (include "dummy-fuse-csi.name" .) -}}
 {{- end -}}
+
+{{/*
+Create pod restarter controller Deployment name.
+*/}}
+{{- define "dummy-fuse-csi.name.podrestarter" -}}
+{{- printf "%s-podrestarter" (include "dummy-fuse-csi.name" .) -}}
+{{- end -}}
+
+{{/*
+Create controller plugin Deployment name.
+*/}}
+{{- define "dummy-fuse-csi.name.controllerplugin" -}}
+{{- printf "%s-controllerplugin" (include "dummy-fuse-csi.name" .) -}}
+{{- end -}}
+
+{{/*
+Create mount proxy DaemonSet name.
+*/}}
+{{- define "dummy-fuse-csi.name.mountproxy" -}}
+{{- printf "%s-mountproxy" (include "dummy-fuse-csi.name" .) -}}
+{{- end -}}
+
+{{/*
+Create fd store DaemonSet name.
+*/}}
+{{- define "dummy-fuse-csi.name.fdstore" -}}
+{{- printf "%s-fdstore" (include "dummy-fuse-csi.name" .) -}}
+{{- end -}}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/driver"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/podrestarter"
+	V "github.com/gman0/dummy-fuse-csi/csi/internal/version"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+var (
+	kubeconfig     = flag.String("kubeconfig", "", "Path to kubeconfig. Leave empty to use in-cluster configuration.")
+	driverName     = flag.String("drivername", driver.DefaultName, "Name of the CSI driver whose volumes are watched.")
+	namespaceLabel = flag.String("namespace-label", driver.DefaultName+"/restart-pods", "Namespaces must have this label set to \"true\" for their Pods to be restarted.")
+	evict          = flag.Bool("evict", false, "Evict Pods instead of deleting them. Eviction respects PodDisruptionBudgets.")
+	restartQPS     = flag.Float64("restart-qps", 0.2, "Maximum number of Pod restarts per second.")
+	restartBurst   = flag.Int("restart-burst", 5, "Maximum burst of Pod restarts.")
+	resync         = flag.Duration("resync", 10*time.Minute, "Informer resync period.")
+	workers        = flag.Int("workers", 2, "Number of worker goroutines.")
+	version        = flag.Bool("version", false, "Print controller version and exit.")
+)
+
+func main() {
+	// Handle flags and initialize logging.
+
+	klog.InitFlags(nil)
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		klog.Exitf("failed to set logtostderr flag: %v", err)
+	}
+	flag.Parse()
+
+	if *version {
+		fmt.Println("Dummy-FUSE CSI controller version", V.FullVersion())
+		os.Exit(0)
+	}
+
+	// Initialize and run the controller.
+
+	log.Infof("Dummy-FUSE CSI controller version %s", V.FullVersion())
+	log.Infof("Command line arguments %v", os.Args)
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatalf("Failed to build client configuration: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	c := podrestarter.New(client, &podrestarter.Opts{
+		DriverName:     *driverName,
+		NamespaceLabel: *namespaceLabel,
+		Evict:          *evict,
+		RestartQPS:     *restartQPS,
+		RestartBurst:   *restartBurst,
+		Resync:         *resync,
+	})
+
+	if err = c.Run(ctx, *workers); err != nil {
+		log.Fatalf("Failed to run the controller: %v", err)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fdstore"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	V "github.com/gman0/dummy-fuse-csi/csi/internal/version"
+
+	"k8s.io/klog/v2"
+)
+
+var (
+	socketPath = flag.String("socket", "/run/dummy-fuse-fdstore/fdstore.sock", "Path to the fd keeper UNIX domain socket.")
+	version    = flag.Bool("version", false, "Print fd keeper version and exit.")
+)
+
+func main() {
+	// Handle flags and initialize logging.
+
+	klog.InitFlags(nil)
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		klog.Exitf("failed to set logtostderr flag: %v", err)
+	}
+	flag.Parse()
+
+	if *version {
+		fmt.Println("Dummy-FUSE fd keeper version", V.FullVersion())
+		os.Exit(0)
+	}
+
+	// Initialize and run the fd keeper.
+
+	log.Infof("Dummy-FUSE fd keeper version %s", V.FullVersion())
+	log.Infof("Command line arguments %v", os.Args)
+
+	if err := fdstore.NewKeeper().Serve(*socketPath); err != nil {
+		log.Fatalf("Failed to run the fd keeper: %v", err)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/grpcutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountproxy"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+	V "github.com/gman0/dummy-fuse-csi/csi/internal/version"
+
+	"k8s.io/klog/v2"
+)
+
+var (
+	endpoint = flag.String("endpoint", "unix:///run/dummy-fuse-mount-proxy/mount-proxy.sock", "Mount proxy endpoint.")
+	version  = flag.Bool("version", false, "Print mount proxy version and exit.")
+
+	mountBackend      = flag.String("mount-backend", string(mountutils.BackendNative), "How are unmounts performed. 'native' uses umount2 syscall directly, 'exec' runs umount binary.")
+	mountProbeTimeout = flag.Duration("mount-probe-timeout", mountutils.DefaultProbeTimeout, "Time after which a mountpoint that doesn't respond to a probe is considered hung.")
+)
+
+func main() {
+	// Handle flags and initialize logging.
+
+	klog.InitFlags(nil)
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		klog.Exitf("failed to set logtostderr flag: %v", err)
+	}
+	flag.Parse()
+
+	if *version {
+		fmt.Println("Dummy-FUSE mount proxy version", V.FullVersion())
+		os.Exit(0)
+	}
+
+	// Initialize and run the mount proxy.
+
+	log.Infof("Dummy-FUSE mount proxy version %s", V.FullVersion())
+	log.Infof("Command line arguments %v", os.Args)
+
+	mountutils.SetProbeTimeout(*mountProbeTimeout)
+
+	b, err := mountutils.ParseBackend(*mountBackend)
+	if err != nil {
+		log.Fatalf("Invalid mount backend: %v", err)
+	}
+	mountutils.SetBackend(b)
+
+	s, err := grpcutils.NewServer(*endpoint)
+	if err != nil {
+		log.Fatalf("Failed to create GRPC server: %v", err)
+	}
+
+	mountproxy.RegisterMountProxyServer(s.GRPCServer, mountproxy.NewServer())
+
+	if err = s.Serve(); err != nil {
+		log.Fatalf("Failed to run the mount proxy: %v", err)
+	}
+
+	os.Exit(0)
+}
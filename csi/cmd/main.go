@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/driver"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/node"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fuselog"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
 	V "github.com/gman0/dummy-fuse-csi/csi/internal/version"
 
 	"k8s.io/klog/v2"
@@ -45,6 +53,44 @@ var (
 	nodeId     = flag.String("nodeid", "", "Node id.")
 	version    = flag.Bool("version", false, "Print driver version and exit.")
 	roles      rolesFlag
+
+	restoreMounts = flag.Bool("restore-mounts", false, "Store mount instructions of staged and published volumes and replay them on startup.")
+	mountCacheDir = flag.String("mountcache-dir", "/csi/mountcache", "Path to a directory where mount instructions are stored when --restore-mounts is enabled.")
+	journalDir    = flag.String("journal-dir", "", "Path to a directory where node operations in progress are recorded, so that operations interrupted by a node plugin restart are rolled forward or back on startup. Empty disables the journal.")
+
+	healthCheckInterval = flag.Duration("health-check-interval", 0, "Interval between mount health checks of staged and published volumes. Zero disables the health monitor.")
+	autoHeal            = flag.Bool("auto-heal", false, "Remount corrupted mounts found by the health monitor.")
+	watchMounts         = flag.Bool("watch-mounts", false, "Watch the mount table and run health checks of staged and published volumes as soon as their mounts change. Requires the health monitor.")
+	kubeletRoot         = flag.String("kubelet-root", kubeletstate.DefaultRoot, "Path to kubelet's root directory, as seen by the node plugin.")
+	discoverVolumes     = flag.Bool("discover-volumes", false, "Discover staged and published volumes of this driver from kubelet's vol_data.json files under --kubelet-root on startup, and restore them. Volumes restored with --restore-mounts take precedence.")
+	orphanGC            = flag.Bool("orphan-gc", false, "On startup, unmount and remove dummy-fuse mounts and empty target directories under --kubelet-root that kubelet doesn't know about anymore.")
+	orphanGCInterval    = flag.Duration("orphan-gc-interval", 0, "Interval between orphan GC runs. Zero runs orphan GC only once on startup.")
+	orphanGCDryRun      = flag.Bool("orphan-gc-dry-run", false, "Only report orphans found by orphan GC, don't remove them.")
+	mountBackend        = flag.String("mount-backend", string(mountutils.BackendNative), "How are bind mounts and unmounts performed. 'native' uses mount syscalls directly, 'exec' runs mount and umount binaries.")
+	mountProbeTimeout   = flag.Duration("mount-probe-timeout", mountutils.DefaultProbeTimeout, "Time after which a mountpoint that doesn't respond to a probe (e.g. its FUSE daemon is stopped) is considered hung.")
+
+	fuseRestartPolicy  = flag.String("fuse-restart-policy", string(node.RestartNever), "When are dummy-fuse processes restarted after they exit: 'never', 'on-failure' or 'always'. Doesn't apply with --mount-proxy-endpoint or --fdstore-socket.")
+	mountProxyEndpoint = flag.String("mount-proxy-endpoint", "", "dummy-fuse-mount-proxy endpoint. If set, dummy-fuse is mounted by the mount proxy instead of the node plugin.")
+	fdStoreSocket      = flag.String("fdstore-socket", "", "Path to dummy-fuse-fdstore socket. If set, /dev/fuse session fds of staged volumes are kept alive by the fd keeper.")
+
+	fuseLogDir      = flag.String("fuse-log-dir", "", "Path to a directory where output of dummy-fuse processes is stored, in per-volume log files. Empty disables FUSE log files. Doesn't apply with --mount-proxy-endpoint or --fdstore-socket.")
+	fuseLogMaxSize  = flag.Int64("fuse-log-max-size", fuselog.DefaultMaxSize, "Size in bytes at which a FUSE log file is rotated.")
+	fuseLogMaxFiles = flag.Int("fuse-log-max-files", fuselog.DefaultMaxFiles, "Number of FUSE log files retained per volume, including the current one.")
+	fuseLogMaxAge   = flag.Duration("fuse-log-max-age", 0, "Remove FUSE logs of volumes that are not mounted anymore once they were last written to this long ago. Zero keeps them until they're removed manually.")
+
+	tailFuseLog       = flag.String("tail-fuse-log", "", "Print the FUSE log of this volume ID from --fuse-log-dir and exit.")
+	tailFuseLogLines  = flag.Int("tail-fuse-log-lines", 100, "Number of lines printed by --tail-fuse-log.")
+	tailFuseLogFollow = flag.Bool("tail-fuse-log-follow", false, "Keep printing new lines of the FUSE log with --tail-fuse-log until interrupted.")
+
+	injectMounts = flag.Bool("inject-mounts", false, "After restoring a corrupted staging mount, replace stale mounts in mount namespaces of consumer Pods with fresh bind mounts. Requires host PID namespace.")
+
+	controllerStateDir = flag.String("controller-state-dir", "/var/lib/dummy-fuse-csi/controller", "Path to a directory where the controller service stores its registry of provisioned volumes.")
+
+	backingDir = flag.String("backing-dir", fmt.Sprintf("/var/lib/kubelet/plugins/%s/backing", driver.DefaultName), "Path to a directory where contents of volumes with writer access modes are stored. Must be accessible by dummy-fuse at the same path, including in dummy-fuse-mount-proxy.")
+
+	unstagePolicy = flag.String("unstage-policy", string(node.UnstagePolicyRefuse), "How NodeUnstageVolume handles staging paths still referenced by published volumes. 'refuse' fails the call with FailedPrecondition, 'cleanup' unmounts the referencing volumes first.")
+
+	strictVolumeAttributes = flag.Bool("strict-volume-attributes", false, "Reject volumes with unknown volume attributes. If not set, unknown attributes are logged and ignored.")
 )
 
 func main() {
@@ -63,6 +109,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *tailFuseLog != "" {
+		if err := runTailFuseLog(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize and run the driver.
 
 	log.Infof("Dummy-FUSE CSI plugin version %s", V.FullVersion())
@@ -78,6 +132,38 @@ func main() {
 		CSIEndpoint: *endpoint,
 		NodeID:      *nodeId,
 		Roles:       driverRoles,
+
+		RestoreMounts: *restoreMounts,
+		MountCacheDir: *mountCacheDir,
+		JournalDir:    *journalDir,
+
+		HealthCheckInterval: *healthCheckInterval,
+		AutoHeal:            *autoHeal,
+		WatchMounts:         *watchMounts,
+		KubeletRoot:         *kubeletRoot,
+		DiscoverVolumes:     *discoverVolumes,
+		OrphanGC:            *orphanGC,
+		OrphanGCInterval:    *orphanGCInterval,
+		OrphanGCDryRun:      *orphanGCDryRun,
+		MountProbeTimeout:   *mountProbeTimeout,
+		MountBackend:        *mountBackend,
+
+		FuseRestartPolicy:  *fuseRestartPolicy,
+		FuseLogDir:         *fuseLogDir,
+		FuseLogMaxSize:     *fuseLogMaxSize,
+		FuseLogMaxFiles:    *fuseLogMaxFiles,
+		FuseLogMaxAge:      *fuseLogMaxAge,
+		MountProxyEndpoint: *mountProxyEndpoint,
+		FdStoreSocket:      *fdStoreSocket,
+
+		InjectMounts: *injectMounts,
+
+		ControllerStateDir: *controllerStateDir,
+
+		StrictVolumeAttributes: *strictVolumeAttributes,
+
+		BackingDir:    *backingDir,
+		UnstagePolicy: *unstagePolicy,
 	})
 
 	if err != nil {
@@ -91,3 +177,21 @@ func main() {
 
 	os.Exit(0)
 }
+
+func runTailFuseLog() error {
+	if *fuseLogDir == "" {
+		return errors.New("--tail-fuse-log requires --fuse-log-dir")
+	}
+
+	logs, err := fuselog.New(&fuselog.Opts{Dir: *fuseLogDir})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return logs.Tail(ctx, *tailFuseLog, *tailFuseLogLines, *tailFuseLogFollow, func(line string) {
+		fmt.Println(line)
+	})
+}
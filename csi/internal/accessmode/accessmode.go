@@ -0,0 +1,38 @@
+package accessmode
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Volume access modes supported by both the controller and the node plugin.
+// The value is true for modes that allow writing, in which case dummy-fuse
+// is mounted with a writable backing directory.
+//
+// Note that backing directories are node-local: volumes with multi-node
+// writer access modes are writable, but their contents aren't shared
+// between nodes.
+var supported = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   false,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    false,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+// Validate returns an error if mode is not a supported volume access mode.
+func Validate(mode csi.VolumeCapability_AccessMode_Mode) error {
+	if _, ok := supported[mode]; !ok {
+		return fmt.Errorf("unsupported volume access mode %s", mode)
+	}
+
+	return nil
+}
+
+// IsWriter returns true if mode is a supported access mode that allows writing.
+func IsWriter(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return supported[mode]
+}
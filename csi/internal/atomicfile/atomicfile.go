@@ -0,0 +1,77 @@
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// TmpSuffix is appended to the name of the temporary file
+// that's being written before it's renamed to its final name.
+const TmpSuffix = ".tmp"
+
+// Write writes data into file at p. The data is first written into a temporary
+// file which is then fsync'd and renamed to p, so that readers of p either see
+// the old or the new contents, but never a partially written file.
+func Write(p string, data []byte, perm os.FileMode) error {
+	tmpPath := p + TmpSuffix
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return SyncDir(path.Dir(p))
+}
+
+// Remove removes the file at p and syncs its parent directory.
+// Removing a file that doesn't exist is not an error.
+func Remove(p string) error {
+	if err := os.Remove(p); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return SyncDir(path.Dir(p))
+}
+
+// SyncDir fsyncs directory at p, persisting any renames and removals
+// of its entries.
+func SyncDir(p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %v", p, err)
+	}
+
+	return nil
+}
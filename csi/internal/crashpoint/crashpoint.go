@@ -0,0 +1,51 @@
+package crashpoint
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+
+	"golang.org/x/sys/unix"
+)
+
+// Crash points are used to test crash consistency of node operations.
+// If EnvName environment variable contains the name of a crash point,
+// the process kills itself with SIGKILL once it reaches that point,
+// leaving behind whatever state the operation managed to create:
+//
+//   DUMMY_FUSE_CSI_CRASH_POINTS=stage:mounted,publish:mkdir
+//
+// Crash points are disabled unless the variable is set.
+
+// EnvName is the name of the environment variable with crash point names.
+const EnvName = "DUMMY_FUSE_CSI_CRASH_POINTS"
+
+var enabled = parse(os.Getenv(EnvName))
+
+func parse(v string) map[string]bool {
+	if v == "" {
+		return nil
+	}
+
+	points := make(map[string]bool)
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			points[p] = true
+		}
+	}
+
+	return points
+}
+
+// Hit kills the process if crash point name is enabled.
+func Hit(name string) {
+	if !enabled[name] {
+		return
+	}
+
+	log.Warningf("Reached crash point %s, killing the process", name)
+
+	unix.Kill(os.Getpid(), unix.SIGKILL)
+	select {}
+}
@@ -0,0 +1,382 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/accessmode"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// Opts holds init-time Controller server configuration.
+	Opts struct {
+		// Registry stores provisioned volumes.
+		Registry *Registry
+
+		// StrictVolumeAttributes enables rejecting StorageClass
+		// parameters that are not known volume attributes.
+		StrictVolumeAttributes bool
+	}
+
+	// Server implements csi.ControllerServer interface.
+	Server struct {
+		caps     []*csi.ControllerServiceCapability
+		registry *Registry
+
+		strictVolumeAttrs bool
+	}
+)
+
+var (
+	_ csi.ControllerServer = (*Server)(nil)
+)
+
+const (
+	// Capacity of volumes created without a capacity range.
+	// dummy-fuse doesn't store any data, so this is purely informational.
+	defaultVolumeCapacityBytes = 1 << 30
+)
+
+func New(opts *Opts) *Server {
+	enabledCaps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	}
+
+	var caps []*csi.ControllerServiceCapability
+	for _, c := range enabledCaps {
+		caps = append(caps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+
+	return &Server{
+		caps:     caps,
+		registry: opts.Registry,
+
+		strictVolumeAttrs: opts.StrictVolumeAttributes,
+	}
+}
+
+func (srv *Server) ControllerGetCapabilities(
+	ctx context.Context,
+	req *csi.ControllerGetCapabilitiesRequest,
+) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: srv.caps,
+	}, nil
+}
+
+func (srv *Server) CreateVolume(
+	ctx context.Context,
+	req *csi.CreateVolumeRequest,
+) (*csi.CreateVolumeResponse, error) {
+	if err := validateCreateVolumeRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Parameters are passed to the node plugin as volume context.
+	// Validate them early, so that misconfigured StorageClasses
+	// fail on provisioning instead of on mount.
+	_, unknownKeys, err := volumeattrs.Parse(req.GetParameters(), srv.strictVolumeAttrs)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(unknownKeys) > 0 {
+		log.Warningf("Ignoring unknown volume attributes %v of volume %s, supported attributes are %v",
+			unknownKeys, req.GetName(), volumeattrs.Keys())
+	}
+
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if capacity == 0 {
+		capacity = req.GetCapacityRange().GetLimitBytes()
+	}
+	if capacity == 0 {
+		capacity = defaultVolumeCapacityBytes
+	}
+
+	caps := capabilityKeys(req.GetVolumeCapabilities())
+
+	vol, existed, err := srv.registry.Create(req.GetName(), capacity, req.GetParameters(), caps)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create volume %s: %v", req.GetName(), err)
+	}
+
+	if existed {
+		if !capacityInRange(vol.CapacityBytes, req.GetCapacityRange()) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"volume %s already exists with incompatible capacity %d", req.GetName(), vol.CapacityBytes)
+		}
+
+		if !equalParameters(vol.Parameters, req.GetParameters()) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"volume %s already exists with different parameters %v", req.GetName(), vol.Parameters)
+		}
+
+		if !equalStrings(vol.Capabilities, caps) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"volume %s already exists with different volume capabilities %v", req.GetName(), vol.Capabilities)
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.ID,
+			CapacityBytes: vol.CapacityBytes,
+			VolumeContext: vol.Parameters,
+		},
+	}, nil
+}
+
+func (srv *Server) DeleteVolume(
+	ctx context.Context,
+	req *csi.DeleteVolumeRequest,
+) (*csi.DeleteVolumeResponse, error) {
+	if err := validateDeleteVolumeRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := srv.registry.Delete(req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete volume %s: %v", req.GetVolumeId(), err)
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (srv *Server) ValidateVolumeCapabilities(
+	ctx context.Context,
+	req *csi.ValidateVolumeCapabilitiesRequest,
+) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if err := validateValidateVolumeCapabilitiesRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if srv.registry.Get(req.GetVolumeId()) == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+	}
+
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateVolumeCapability(c); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+func (srv *Server) ControllerPublishVolume(
+	ctx context.Context,
+	req *csi.ControllerPublishVolumeRequest,
+) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) ControllerUnpublishVolume(
+	ctx context.Context,
+	req *csi.ControllerUnpublishVolumeRequest,
+) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) ListVolumes(
+	ctx context.Context,
+	req *csi.ListVolumesRequest,
+) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) GetCapacity(
+	ctx context.Context,
+	req *csi.GetCapacityRequest,
+) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) CreateSnapshot(
+	ctx context.Context,
+	req *csi.CreateSnapshotRequest,
+) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) DeleteSnapshot(
+	ctx context.Context,
+	req *csi.DeleteSnapshotRequest,
+) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) ListSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest,
+) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest,
+) (*csi.ControllerExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (srv *Server) ControllerGetVolume(
+	ctx context.Context,
+	req *csi.ControllerGetVolumeRequest,
+) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func capacityInRange(capacity int64, capRange *csi.CapacityRange) bool {
+	if capRange == nil {
+		return true
+	}
+
+	if req := capRange.GetRequiredBytes(); req > 0 && capacity < req {
+		return false
+	}
+
+	if limit := capRange.GetLimitBytes(); limit > 0 && capacity > limit {
+		return false
+	}
+
+	return true
+}
+
+// capabilityKey returns a string that identifies volume capability c.
+func capabilityKey(c *csi.VolumeCapability) string {
+	return fmt.Sprintf("%s,fsType=%s,mountFlags=%s",
+		c.GetAccessMode().GetMode(), c.GetMount().GetFsType(), strings.Join(c.GetMount().GetMountFlags(), ";"))
+}
+
+// capabilityKeys returns sorted, deduplicated keys of volume capabilities caps.
+func capabilityKeys(caps []*csi.VolumeCapability) []string {
+	seen := make(map[string]struct{}, len(caps))
+	var keys []string
+
+	for _, c := range caps {
+		key := capabilityKey(c)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func equalParameters(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validateVolumeCapability(c *csi.VolumeCapability) error {
+	if c.GetBlock() != nil {
+		return errors.New("volume access type Block is unsupported")
+	}
+
+	if c.GetMount() == nil {
+		return errors.New("volume access type must by Mount")
+	}
+
+	return accessmode.Validate(c.GetAccessMode().GetMode())
+}
+
+func validateCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
+	if req.GetName() == "" {
+		return errors.New("volume name missing in request")
+	}
+
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return errors.New("volume capabilities missing in request")
+	}
+
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateVolumeCapability(c); err != nil {
+			return err
+		}
+	}
+
+	if req.GetVolumeContentSource() != nil {
+		return errors.New("volume content source is unsupported")
+	}
+
+	if capRange := req.GetCapacityRange(); capRange != nil {
+		if capRange.GetRequiredBytes() < 0 || capRange.GetLimitBytes() < 0 {
+			return errors.New("capacity range must not be negative")
+		}
+
+		if capRange.GetLimitBytes() > 0 && capRange.GetRequiredBytes() > capRange.GetLimitBytes() {
+			return errors.New("required capacity exceeds capacity limit")
+		}
+	}
+
+	return nil
+}
+
+func validateDeleteVolumeRequest(req *csi.DeleteVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return errors.New("volume ID missing in request")
+	}
+
+	return nil
+}
+
+func validateValidateVolumeCapabilitiesRequest(req *csi.ValidateVolumeCapabilitiesRequest) error {
+	if req.GetVolumeId() == "" {
+		return errors.New("volume ID missing in request")
+	}
+
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return errors.New("volume capabilities missing in request")
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/atomicfile"
+)
+
+type (
+	// Volume is a dynamically provisioned dummy-fuse volume.
+	Volume struct {
+		ID            string            `json:"id"`
+		Name          string            `json:"name"`
+		CapacityBytes int64             `json:"capacityBytes"`
+		Parameters    map[string]string `json:"parameters,omitempty"`
+
+		// Capabilities holds keys of the volume capabilities the volume
+		// was created with, see capabilityKey.
+		Capabilities []string `json:"capabilities,omitempty"`
+
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	// Registry is a persistent store of provisioned volumes.
+	// The whole registry is stored in a single file that's
+	// rewritten atomically on each change.
+	Registry struct {
+		mu sync.Mutex
+
+		filePath string
+		volumes  map[string]*Volume // Keyed by volume ID.
+	}
+)
+
+const (
+	registryFileName = "volumes.json"
+
+	// Prefix of generated volume IDs.
+	volumeIDPrefix = "dummy-fuse-"
+)
+
+// NewRegistry loads the volume registry from dir, or creates
+// a new empty one if it doesn't exist yet.
+func NewRegistry(dir string) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create registry directory %s: %v", dir, err)
+	}
+
+	r := &Registry{
+		filePath: path.Join(dir, registryFileName),
+		volumes:  make(map[string]*Volume),
+	}
+
+	b, err := os.ReadFile(r.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+
+		return nil, fmt.Errorf("failed to read volume registry %s: %v", r.filePath, err)
+	}
+
+	var volumes []*Volume
+	if err = json.Unmarshal(b, &volumes); err != nil {
+		return nil, fmt.Errorf("failed to parse volume registry %s: %v", r.filePath, err)
+	}
+
+	for _, vol := range volumes {
+		r.volumes[vol.ID] = vol
+	}
+
+	return r, nil
+}
+
+// save persists the registry. Must be called with r.mu held.
+func (r *Registry) save() error {
+	volumes := make([]*Volume, 0, len(r.volumes))
+	for _, vol := range r.volumes {
+		volumes = append(volumes, vol)
+	}
+
+	b, err := json.Marshal(volumes)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(r.filePath, b, 0600)
+}
+
+func generateVolumeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return volumeIDPrefix + hex.EncodeToString(b), nil
+}
+
+// getByName returns volume with the given name, or nil if there's
+// no such volume. Must be called with r.mu held.
+func (r *Registry) getByName(name string) *Volume {
+	for _, vol := range r.volumes {
+		if vol.Name == name {
+			return vol
+		}
+	}
+
+	return nil
+}
+
+// Get returns volume with the given ID, or nil if there's no such volume.
+func (r *Registry) Get(volID string) *Volume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if vol, ok := r.volumes[volID]; ok {
+		v := *vol
+		return &v
+	}
+
+	return nil
+}
+
+// Create registers a new volume with a generated volume ID. If a volume
+// with the same name already exists, it is returned instead and the
+// returned bool is set to true.
+func (r *Registry) Create(name string, capacityBytes int64, params map[string]string, caps []string) (*Volume, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if vol := r.getByName(name); vol != nil {
+		v := *vol
+		return &v, true, nil
+	}
+
+	volID, err := generateVolumeID()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to generate volume ID: %v", err)
+	}
+
+	vol := &Volume{
+		ID:            volID,
+		Name:          name,
+		CapacityBytes: capacityBytes,
+		Parameters:    params,
+		Capabilities:  caps,
+		CreatedAt:     time.Now().UTC(),
+	}
+
+	r.volumes[volID] = vol
+
+	if err = r.save(); err != nil {
+		delete(r.volumes, volID)
+		return nil, false, fmt.Errorf("failed to save volume registry: %v", err)
+	}
+
+	v := *vol
+	return &v, false, nil
+}
+
+// Delete removes volume from the registry. Deleting
+// a volume that doesn't exist is not an error.
+func (r *Registry) Delete(volID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vol, ok := r.volumes[volID]
+	if !ok {
+		return nil
+	}
+
+	delete(r.volumes, volID)
+
+	if err := r.save(); err != nil {
+		r.volumes[volID] = vol
+		return fmt.Errorf("failed to save volume registry: %v", err)
+	}
+
+	return nil
+}
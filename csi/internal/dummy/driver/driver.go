@@ -5,11 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/controller"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/identity"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/dummy/node"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fdstore"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fuselog"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/grpcutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/journal"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountcache"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountproxy"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
@@ -36,6 +44,106 @@ type (
 
 		// Role under which will the driver operate.
 		Roles map[ServiceRole]bool
+
+		// RestoreMounts enables storing mount instructions for staged
+		// and published volumes, and replaying them on startup.
+		RestoreMounts bool
+
+		// MountCacheDir is path to a directory where mount instructions
+		// are stored when RestoreMounts is enabled.
+		MountCacheDir string
+
+		// JournalDir is path to a directory where node operations in progress
+		// are recorded, so that they can be finished after the node plugin
+		// restarts. Empty disables the journal.
+		JournalDir string
+
+		// HealthCheckInterval is the interval between mount health checks
+		// of staged and published volumes. Zero disables the health monitor.
+		HealthCheckInterval time.Duration
+
+		// AutoHeal enables remounting of corrupted mounts found by the health monitor.
+		AutoHeal bool
+
+		// WatchMounts enables running health checks as soon as mounts
+		// of staged and published volumes change. Requires HealthCheckInterval.
+		WatchMounts bool
+
+		// KubeletRoot is path to kubelet's root directory,
+		// as seen by the node plugin.
+		KubeletRoot string
+
+		// DiscoverVolumes enables discovering staged and published
+		// volumes from kubelet's vol_data.json files on startup.
+		DiscoverVolumes bool
+
+		// OrphanGC enables collecting orphaned dummy-fuse mounts
+		// and target directories under KubeletRoot.
+		OrphanGC bool
+
+		// OrphanGCInterval is the interval between orphan GC runs.
+		// Zero runs orphan GC only once on startup.
+		OrphanGCInterval time.Duration
+
+		// OrphanGCDryRun makes orphan GC only report orphans.
+		OrphanGCDryRun bool
+
+		// MountProbeTimeout is the time after which a mountpoint that doesn't
+		// respond to a probe is considered hung.
+		MountProbeTimeout time.Duration
+
+		// MountBackend is the way mount operations are performed,
+		// see mountutils.Backend.
+		MountBackend string
+
+		// FuseRestartPolicy defines when are dummy-fuse processes
+		// restarted after they exit, see node.RestartPolicy.
+		FuseRestartPolicy string
+
+		// FuseLogDir is path to a directory where output of dummy-fuse
+		// processes is stored. Empty disables FUSE log files.
+		FuseLogDir string
+
+		// FuseLogMaxSize is the size in bytes at which a FUSE log file is rotated.
+		FuseLogMaxSize int64
+
+		// FuseLogMaxFiles is the number of FUSE log files retained per volume.
+		FuseLogMaxFiles int
+
+		// FuseLogMaxAge is the time after the last write at which FUSE logs
+		// of volumes that are not mounted anymore are removed. Zero keeps
+		// them forever.
+		FuseLogMaxAge time.Duration
+
+		// MountProxyEndpoint is URL of the UNIX domain socket where
+		// dummy-fuse-mount-proxy is listening. If set, dummy-fuse is
+		// mounted by the proxy instead of the node plugin.
+		MountProxyEndpoint string
+
+		// FdStoreSocket is path to the UNIX domain socket where
+		// dummy-fuse-fdstore is listening. If set, /dev/fuse session
+		// fds of staged volumes are registered with the fd keeper.
+		FdStoreSocket string
+
+		// InjectMounts enables replacing stale mounts in mount namespaces
+		// of consumer Pods after a corrupted staging mount is restored.
+		InjectMounts bool
+
+		// ControllerStateDir is path to a directory where the controller
+		// service stores its registry of provisioned volumes.
+		ControllerStateDir string
+
+		// StrictVolumeAttributes enables rejecting volumes
+		// with unknown volume attributes.
+		StrictVolumeAttributes bool
+
+		// BackingDir is path to a directory where contents
+		// of volumes with writer access modes are stored.
+		BackingDir string
+
+		// UnstagePolicy defines how NodeUnstageVolume handles staging paths
+		// that are still referenced by published volumes: "refuse" or "cleanup".
+		UnstagePolicy string
 	}
 
 	// Driver holds CVMFS-CSI driver runtime state.
@@ -93,6 +201,60 @@ func (o *Opts) validate() error {
 		return err
 	}
 
+	if o.RestoreMounts {
+		if err := required("mountcache-dir", o.MountCacheDir); err != nil {
+			return err
+		}
+	}
+
+	if o.Roles[NodeServiceRole] {
+		if err := required("backing-dir", o.BackingDir); err != nil {
+			return err
+		}
+
+		if _, err := node.ParseUnstagePolicy(o.UnstagePolicy); err != nil {
+			return err
+		}
+
+		if o.WatchMounts && o.HealthCheckInterval <= 0 {
+			return errors.New("watch-mounts requires health-check-interval to be positive")
+		}
+
+		if o.OrphanGC || o.DiscoverVolumes {
+			if err := required("kubelet-root", o.KubeletRoot); err != nil {
+				return err
+			}
+		}
+
+		if o.OrphanGC {
+			if o.OrphanGCInterval < 0 {
+				return errors.New("orphan-gc-interval must not be negative")
+			}
+		}
+
+		if o.MountProbeTimeout <= 0 {
+			return errors.New("mount-probe-timeout must be positive")
+		}
+
+		if _, err := mountutils.ParseBackend(o.MountBackend); err != nil {
+			return err
+		}
+
+		if _, err := node.ParseRestartPolicy(o.FuseRestartPolicy); err != nil {
+			return err
+		}
+	}
+
+	if o.Roles[ControllerServiceRole] {
+		if err := required("controller-state-dir", o.ControllerStateDir); err != nil {
+			return err
+		}
+	}
+
+	if o.MountProxyEndpoint != "" && o.FdStoreSocket != "" {
+		return errors.New("mount-proxy-endpoint and fdstore-socket are mutually exclusive")
+	}
+
 	return nil
 }
 
@@ -121,7 +283,83 @@ func setupIdentityServiceRole(s *grpc.Server, d *Driver) error {
 }
 
 func setupNodeServiceRole(s *grpc.Server, d *Driver) error {
-	ns := node.New(d.NodeID)
+	mountutils.SetProbeTimeout(d.MountProbeTimeout)
+
+	mountBackend, _ := mountutils.ParseBackend(d.MountBackend)
+	mountutils.SetBackend(mountBackend)
+	log.Infof("Using %s mount backend", mountBackend)
+
+	var mc *mountcache.Cache
+	if d.RestoreMounts {
+		var err error
+		if mc, err = mountcache.New(d.MountCacheDir); err != nil {
+			return fmt.Errorf("failed to initialize mount cache: %v", err)
+		}
+	}
+
+	var jrnl *journal.Journal
+	if d.JournalDir != "" {
+		var err error
+		if jrnl, err = journal.New(d.JournalDir); err != nil {
+			return fmt.Errorf("failed to initialize journal: %v", err)
+		}
+	}
+
+	var logs *fuselog.Store
+	if d.FuseLogDir != "" {
+		var err error
+		logs, err = fuselog.New(&fuselog.Opts{
+			Dir:      d.FuseLogDir,
+			MaxSize:  d.FuseLogMaxSize,
+			MaxFiles: d.FuseLogMaxFiles,
+			MaxAge:   d.FuseLogMaxAge,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize FUSE log store: %v", err)
+		}
+
+		log.Infof("Storing dummy-fuse logs in %s", d.FuseLogDir)
+	}
+
+	var mp *mountproxy.Client
+	if d.MountProxyEndpoint != "" {
+		var err error
+		if mp, err = mountproxy.NewClient(d.MountProxyEndpoint); err != nil {
+			return fmt.Errorf("failed to create mount proxy client: %v", err)
+		}
+
+		log.Infof("Using mount proxy at %s", d.MountProxyEndpoint)
+	}
+
+	var fds *fdstore.Client
+	if d.FdStoreSocket != "" {
+		fds = fdstore.NewClient(d.FdStoreSocket)
+		log.Infof("Using fd keeper at %s", d.FdStoreSocket)
+	}
+
+	ns := node.New(&node.Opts{
+		NodeID:              d.NodeID,
+		DriverName:          d.DriverName,
+		MountCache:          mc,
+		Journal:             jrnl,
+		HealthCheckInterval: d.HealthCheckInterval,
+		AutoHeal:            d.AutoHeal,
+		WatchMounts:         d.WatchMounts,
+		KubeletRoot:         d.KubeletRoot,
+		DiscoverVolumes:     d.DiscoverVolumes,
+		OrphanGC:            d.OrphanGC,
+		OrphanGCInterval:    d.OrphanGCInterval,
+		OrphanGCDryRun:      d.OrphanGCDryRun,
+		FuseRestartPolicy:   node.RestartPolicy(d.FuseRestartPolicy),
+		FuseLogs:            logs,
+		MountProxy:          mp,
+		FdStore:             fds,
+		InjectMounts:        d.InjectMounts,
+
+		StrictVolumeAttributes: d.StrictVolumeAttributes,
+		BackingDir:             d.BackingDir,
+		UnstagePolicy:          node.UnstagePolicy(d.UnstagePolicy),
+	})
 
 	caps, err := ns.NodeGetCapabilities(
 		context.TODO(),
@@ -131,12 +369,58 @@ func setupNodeServiceRole(s *grpc.Server, d *Driver) error {
 		return fmt.Errorf("failed to get Node server capabilities: %v", err)
 	}
 
+	if jrnl != nil {
+		log.Infof("Replaying interrupted operations from journal in %s", d.JournalDir)
+		ns.ReplayJournal()
+	}
+
+	if d.RestoreMounts {
+		log.Infof("Attempting to re-mount volumes")
+		ns.RestoreMounts()
+	}
+
+	if d.DiscoverVolumes {
+		log.Infof("Attempting to discover volumes from kubelet's state in %s", d.KubeletRoot)
+		ns.DiscoverVolumes()
+	}
+
+	ns.StartHealthMonitor()
+	ns.StartMountWatcher()
+	ns.StartOrphanGC()
+	ns.StartFuseLogCleanup()
+	ns.StartStateDumper()
+
 	log.Debugf("Registering Node server with capabilities %+v", caps.GetCapabilities())
 	csi.RegisterNodeServer(s, ns)
 
 	return nil
 }
 
+func setupControllerServiceRole(s *grpc.Server, d *Driver) error {
+	registry, err := controller.NewRegistry(d.ControllerStateDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize volume registry: %v", err)
+	}
+
+	cs := controller.New(&controller.Opts{
+		Registry:               registry,
+		StrictVolumeAttributes: d.StrictVolumeAttributes,
+	})
+
+	caps, err := cs.ControllerGetCapabilities(
+		context.TODO(),
+		&csi.ControllerGetCapabilitiesRequest{},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get Controller server capabilities: %v", err)
+	}
+
+	log.Debugf("Registering Controller server with capabilities %+v", caps.GetCapabilities())
+	csi.RegisterControllerServer(s, cs)
+
+	return nil
+}
+
 // Run starts CSI services and blocks.
 func (d *Driver) Run() error {
 	log.Infof("Driver: %s", d.DriverName)
@@ -158,5 +442,11 @@ func (d *Driver) Run() error {
 		}
 	}
 
+	if d.Opts.Roles[ControllerServiceRole] {
+		if err = setupControllerServiceRole(s.GRPCServer, d); err != nil {
+			return fmt.Errorf("failed to setup controller service role: %v", err)
+		}
+	}
+
 	return s.Serve()
 }
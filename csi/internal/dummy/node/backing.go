@@ -0,0 +1,69 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volid"
+)
+
+// backingDirOption is a dummy-fuse option that makes the filesystem writable,
+// storing its contents in a backing directory. It's consumed by dummy-fuse
+// and never passed to the kernel.
+const backingDirOption = "backing_dir"
+
+// dummyFuseOnlyOptions are understood only by dummy-fuse itself.
+var dummyFuseOnlyOptions = []string{backingDirOption}
+
+func isDummyFuseOnlyOption(opt string) bool {
+	key, _, _ := strings.Cut(opt, "=")
+	for _, o := range dummyFuseOnlyOptions {
+		if key == o {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasBackingDir reports whether FUSE mount options make the volume writable.
+func hasBackingDir(opts []string) bool {
+	for _, opt := range opts {
+		if key, _, _ := strings.Cut(opt, "="); key == backingDirOption {
+			return true
+		}
+	}
+
+	return false
+}
+
+// volumeBackingDir returns path to the backing directory of volumeID.
+func (srv *Server) volumeBackingDir(volumeID string) string {
+	return path.Join(srv.backingDir, volid.Escape(volumeID))
+}
+
+// fuseMountOptions returns FUSE mount options for volumeID. Volumes
+// with writer access modes are backed by a node-local directory,
+// which is created if it doesn't exist yet.
+func (srv *Server) fuseMountOptions(volumeID string, writable bool, opts []string) ([]string, error) {
+	if !writable {
+		return opts, nil
+	}
+
+	dir := srv.volumeBackingDir(volumeID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backing directory %s: %v", dir, err)
+	}
+
+	fuseOpts := make([]string, 0, len(opts)+1)
+	fuseOpts = append(fuseOpts, opts...)
+
+	return append(fuseOpts, fmt.Sprintf("%s=%s", backingDirOption, dir)), nil
+}
+
+// removeBackingDir removes the backing directory of volumeID, including its contents.
+func (srv *Server) removeBackingDir(volumeID string) error {
+	return os.RemoveAll(srv.volumeBackingDir(volumeID))
+}
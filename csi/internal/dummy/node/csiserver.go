@@ -5,37 +5,233 @@ import (
 	"errors"
 	"fmt"
 	"os"
-
+	"strings"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/accessmode"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/crashpoint"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fdstore"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fuselog"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/journal"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountcache"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountproxy"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/moby/sys/mountinfo"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func reconcileStagingPath(stagingPath string) error {
-	return reconcileMount(stagingPath, mountDummyFuse)
+// reconcileFuseMount reconciles a mountpoint where dummy-fuse is mounted directly,
+// i.e. a staging path, or a target path of an ephemeral volume.
+func (srv *Server) reconcileFuseMount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	var staleMnt *mountinfo.Info
+	if srv.injectMounts {
+		var err error
+		if staleMnt, err = mountutils.GetMountInfo(mountpoint); err != nil {
+			return fmt.Errorf("failed to read mount table entry of %s: %v", mountpoint, err)
+		}
+	}
+
+	err := reconcileMount(ctx, mountpoint, func(mountpoint string) error {
+		return srv.fuseMounter.mount(ctx, volumeID, mountpoint, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	if staleMnt != nil {
+		srv.injectRestoredMount(volumeID, mountpoint, staleMnt)
+	}
+
+	return nil
 }
 
-func reconcilePublishPath(stagingPath, publishPath string) error {
-	return reconcileMount(publishPath, func(mountpoint string) error {
-		return bindMount(stagingPath, mountpoint)
+func (srv *Server) reconcileStagingPath(ctx context.Context, volumeID, stagingPath string, opts []string) error {
+	return srv.reconcileFuseMount(ctx, volumeID, stagingPath, opts)
+}
+
+func (srv *Server) reconcileEphemeralPath(ctx context.Context, volumeID, targetPath string, opts []string) error {
+	return srv.reconcileFuseMount(ctx, volumeID, targetPath, opts)
+}
+
+func reconcilePublishPath(
+	ctx context.Context,
+	stagingPath, publishPath string,
+	mode volumeattrs.PublishMode,
+	flags []string,
+) error {
+	return reconcileMount(ctx, publishPath, func(mountpoint string) error {
+		if mode == volumeattrs.PublishModeRbindSlave {
+			return slaveRecursiveBind(ctx, stagingPath, mountpoint, flags)
+		}
+
+		return bindMount(ctx, stagingPath, mountpoint, flags)
 	})
 }
 
-// Server implements csi.NodeServer interface.
-type Server struct {
-	nodeID string
-	caps   []*csi.NodeServiceCapability
+// unmountPublishPath unmounts the bind mount mnt of a staging path in publishPath.
+// Publish paths bind mounted with PublishModeRbindSlave have submounts, and are
+// unmounted recursively. The publish mode of untracked volumes is recovered from
+// the mount table, like DiscoverVolumes does.
+func (srv *Server) unmountPublishPath(ctx context.Context, publishPath string, mnt *mountinfo.Info) error {
+	rbindSlave := false
+	if v := srv.volumes.getPublished(publishPath); v != nil {
+		rbindSlave = v.cfg != nil && v.cfg.PublishMode == volumeattrs.PublishModeRbindSlave
+	} else {
+		rbindSlave = mnt != nil && strings.Contains(mnt.Optional, "master:")
+	}
+
+	if rbindSlave {
+		return recursiveUnmount(ctx, publishPath)
+	}
+
+	return unmountBind(ctx, publishPath)
 }
 
+// parseVolumeAttributes parses volume context of volumeID into volume configuration.
+func (srv *Server) parseVolumeAttributes(volumeID string, volCtx map[string]string) (*volumeattrs.Config, error) {
+	cfg, unknownKeys, err := volumeattrs.Parse(volCtx, srv.strictVolumeAttrs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(unknownKeys) > 0 {
+		log.Warningf("Ignoring unknown volume attributes %v of volume %s, supported attributes are %v",
+			unknownKeys, volumeID, volumeattrs.Keys())
+	}
+
+	return cfg, nil
+}
+
+type (
+	// Opts holds init-time Node server configuration.
+	Opts struct {
+		// NodeID is unique identifier of the node on which this
+		// node plugin pod is running.
+		NodeID string
+
+		// DriverName is the name of this CSI driver, as stored
+		// by kubelet in vol_data.json files.
+		DriverName string
+
+		// MountCache, if set, is used to persist mount instructions
+		// of staged and published volumes. See Server.RestoreMounts.
+		MountCache *mountcache.Cache
+
+		// Journal, if set, records node operations while they are in progress,
+		// so that interrupted ones can be finished. See Server.ReplayJournal.
+		Journal *journal.Journal
+
+		// HealthCheckInterval is the interval between mount health checks
+		// of staged and published volumes. Zero disables the health monitor.
+		HealthCheckInterval time.Duration
+
+		// AutoHeal enables remounting of corrupted mounts found by the health monitor.
+		AutoHeal bool
+
+		// WatchMounts enables watching the mount table for changes of staged
+		// and published volumes, and running their health checks right away.
+		// Requires the health monitor.
+		WatchMounts bool
+
+		// KubeletRoot is path to kubelet's root directory, as seen
+		// by the node plugin. Used by volume discovery and orphan GC.
+		// Defaults to kubeletstate.DefaultRoot.
+		KubeletRoot string
+
+		// DiscoverVolumes enables discovering staged and published volumes
+		// from kubelet's vol_data.json files on startup, see DiscoverVolumes.
+		DiscoverVolumes bool
+
+		// OrphanGC enables collecting orphaned dummy-fuse mounts and target
+		// directories under KubeletRoot on startup, see StartOrphanGC.
+		OrphanGC bool
+
+		// OrphanGCInterval is the interval between orphan GC runs.
+		// Zero runs orphan GC only once on startup.
+		OrphanGCInterval time.Duration
+
+		// OrphanGCDryRun makes orphan GC only report orphans instead of removing them.
+		OrphanGCDryRun bool
+
+		// FuseRestartPolicy defines when are dummy-fuse processes restarted
+		// after they exit. Applies only when neither MountProxy nor FdStore
+		// are used. Defaults to RestartNever.
+		FuseRestartPolicy RestartPolicy
+
+		// FuseLogs, if set, stores output of dummy-fuse processes in per-volume
+		// log files. Applies only when neither MountProxy nor FdStore are used.
+		FuseLogs *fuselog.Store
+
+		// MountProxy, if set, is used to mount dummy-fuse instead
+		// of running it in the node plugin container.
+		MountProxy *mountproxy.Client
+
+		// FdStore, if set, is used to keep /dev/fuse session fds of staged
+		// volumes alive across FUSE daemon restarts. Mutually exclusive
+		// with MountProxy.
+		FdStore *fdstore.Client
+
+		// InjectMounts enables replacing stale mounts in mount namespaces
+		// of consumer Pods after a corrupted staging mount is restored.
+		InjectMounts bool
+
+		// StrictVolumeAttributes enables rejecting volumes with
+		// unknown volume attributes. See volumeattrs.Schema.
+		StrictVolumeAttributes bool
+
+		// BackingDir is path to a directory where contents of volumes
+		// with writer access modes are stored. Each volume is stored
+		// in its own subdirectory.
+		BackingDir string
+
+		// UnstagePolicy defines how NodeUnstageVolume handles staging paths
+		// that are still referenced by published volumes. Defaults to
+		// UnstagePolicyRefuse.
+		UnstagePolicy UnstagePolicy
+	}
+
+	// Server implements csi.NodeServer interface.
+	Server struct {
+		nodeID     string
+		driverName string
+		caps       []*csi.NodeServiceCapability
+
+		fuseMounter   fuseMounter
+		mountCache    *mountcache.Cache
+		journal       *journal.Journal
+		volumes       *volumeTracker
+		healthMonitor *healthMonitor
+		watchMounts   bool
+		injectMounts  bool
+
+		kubeletRoot     string
+		discoverVolumes bool
+		orphanGC        *orphanGC
+
+		strictVolumeAttrs bool
+		backingDir        string
+		unstagePolicy     UnstagePolicy
+
+		inFlight *inFlight
+	}
+)
+
 var (
 	_ csi.NodeServer = (*Server)(nil)
 )
 
-func New(nodeID string) *Server {
+func New(opts *Opts) *Server {
 	enabledCaps := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 
 	var caps []*csi.NodeServiceCapability
@@ -49,9 +245,57 @@ func New(nodeID string) *Server {
 		})
 	}
 
+	var hm *healthMonitor
+	if opts.HealthCheckInterval > 0 {
+		hm = newHealthMonitor(opts.HealthCheckInterval, opts.AutoHeal)
+	}
+
+	unstagePolicy := opts.UnstagePolicy
+	if unstagePolicy == "" {
+		unstagePolicy = UnstagePolicyRefuse
+	}
+
+	kubeletRoot := opts.KubeletRoot
+	if kubeletRoot == "" {
+		kubeletRoot = kubeletstate.DefaultRoot
+	}
+
+	var gc *orphanGC
+	if opts.OrphanGC {
+		gc = &orphanGC{
+			interval: opts.OrphanGCInterval,
+			dryRun:   opts.OrphanGCDryRun,
+		}
+	}
+
+	var fm fuseMounter = &localFuseMounter{sup: newFuseSupervisor(opts.FuseRestartPolicy, opts.FuseLogs)}
+	if opts.MountProxy != nil {
+		fm = &proxyFuseMounter{c: opts.MountProxy}
+	} else if opts.FdStore != nil {
+		fm = &fdStoreFuseMounter{c: opts.FdStore}
+	}
+
 	return &Server{
-		nodeID: nodeID,
-		caps:   caps,
+		nodeID:        opts.NodeID,
+		driverName:    opts.DriverName,
+		caps:          caps,
+		fuseMounter:   fm,
+		mountCache:    opts.MountCache,
+		journal:       opts.Journal,
+		volumes:       newVolumeTracker(),
+		healthMonitor: hm,
+		watchMounts:   opts.WatchMounts && hm != nil,
+		injectMounts:  opts.InjectMounts,
+
+		kubeletRoot:     kubeletRoot,
+		discoverVolumes: opts.DiscoverVolumes,
+		orphanGC:        gc,
+
+		strictVolumeAttrs: opts.StrictVolumeAttributes,
+		backingDir:        opts.BackingDir,
+		unstagePolicy:     unstagePolicy,
+
+		inFlight: newInFlight(),
 	}
 }
 
@@ -81,26 +325,96 @@ func (srv *Server) NodePublishVolume(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	done, err := srv.startOperation(req.GetVolumeId(), req.GetTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	mntOpts, err := parseMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags(), req.GetReadonly())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volCfg, err := srv.parseVolumeAttributes(req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	stagingPath := req.GetStagingTargetPath()
 	targetPath := req.GetTargetPath()
 
+	commit, err := srv.beginJournaled(journal.OpPublish, req.GetVolumeId(), stagingPath, targetPath, req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer commit()
+
+	crashpoint.Hit("publish:begin")
+
+	// A corrupted mount left in targetPath, e.g. by a node plugin that was
+	// killed while publishing the volume, makes targetPath inaccessible.
+	if err := unmountCorrupted(ctx, targetPath); err != nil {
+		return nil, operationError(ctx, err,
+			"failed to recover mountpoint %s: %v", targetPath, err)
+	}
+
 	if err := os.MkdirAll(targetPath, 0700); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"failed to create mountpoint directory at %s: %v", targetPath, err)
 	}
 
+	crashpoint.Hit("publish:mkdir")
+
+	if isEphemeralVolume(req.GetVolumeContext()) {
+		return srv.publishEphemeralVolume(ctx, req, mntOpts, volCfg)
+	}
+
 	// Reconcile staging and publish volume paths.
 
-	if err := reconcileStagingPath(stagingPath); err != nil {
-		return nil, status.Errorf(codes.Internal,
+	fuseOpts, err := srv.fuseMountOptions(req.GetVolumeId(),
+		accessmode.IsWriter(req.GetVolumeCapability().GetAccessMode().GetMode()), mntOpts.fuse)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := srv.reconcileStagingPath(ctx, req.GetVolumeId(), stagingPath, fuseOpts); err != nil {
+		return nil, operationError(ctx, err,
 			"failed to reconcile mountpoint %s: %v", stagingPath, err)
 	}
 
-	if err := reconcilePublishPath(stagingPath, targetPath); err != nil {
-		return nil, status.Errorf(codes.Internal,
+	crashpoint.Hit("publish:staged")
+
+	if err := reconcilePublishPath(ctx, stagingPath, targetPath, volCfg.PublishMode, mntOpts.vfs); err != nil {
+		return nil, operationError(ctx, err,
 			"failed to reconcile mountpoint %s: %v", targetPath, err)
 	}
 
+	crashpoint.Hit("publish:mounted")
+
+	srv.volumes.addPublished(&publishedVolume{
+		volumeID:     req.GetVolumeId(),
+		stagingPath:  stagingPath,
+		targetPath:   targetPath,
+		mountOptions: mntOpts.vfs,
+		cfg:          volCfg,
+	})
+
+	if srv.mountCache != nil && volCfg.RestoreMount {
+		if err := srv.mountCache.SavePublished(&mountcache.PublishedEntry{
+			VolumeID:          req.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			MountOptions:      mntOpts.vfs,
+			VolumeAttributes:  req.GetVolumeContext(),
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to save publish mount cache entry for %s: %v", targetPath, err)
+		}
+
+		crashpoint.Hit("publish:cached")
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -112,19 +426,75 @@ func (srv *Server) NodeUnpublishVolume(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	done, err := srv.startOperation(req.GetVolumeId(), req.GetTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	targetPath := req.GetTargetPath()
 
+	commit, err := srv.beginJournaled(journal.OpUnpublish, req.GetVolumeId(), "", targetPath, req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer commit()
+
+	crashpoint.Hit("unpublish:begin")
+
 	// Unmount targetPath and remove the mountpoint (required by the CSI spec).
 
-	if err := mountutils.Unmount(targetPath); err != nil {
+	mnt, err := mountutils.GetMountInfo(targetPath)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal,
-			"failed to unmount %s: %v", targetPath, err)
+			"failed to read mount table entry of %s: %v", targetPath, err)
 	}
 
+	if mnt != nil && mnt.FSType != dummyFuseFSType {
+		// Never unmount anything else than what we've mounted.
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"refusing to unmount %s: expected %s mount, found %s", targetPath, dummyFuseFSType, mnt.FSType)
+	}
+
+	var unmountErr error
+	if srv.isEphemeralTarget(targetPath) {
+		// Ephemeral volumes are mounted by the FUSE mounter directly
+		// into the target path. Let it release any resources it holds,
+		// even if the target path is not mounted anymore.
+		unmountErr = srv.fuseMounter.unmount(ctx, req.GetVolumeId(), targetPath)
+
+		// Ephemeral volumes share the lifetime of the Pod, and so does their data.
+		if unmountErr == nil {
+			unmountErr = srv.removeBackingDir(req.GetVolumeId())
+		}
+	} else if mnt == nil {
+		log.Debugf("Target path %s is not mounted, skipping unmount", targetPath)
+	} else {
+		unmountErr = srv.unmountPublishPath(ctx, targetPath, mnt)
+	}
+
+	if unmountErr != nil {
+		return nil, operationError(ctx, unmountErr,
+			"failed to unmount %s: %v", targetPath, unmountErr)
+	}
+
+	crashpoint.Hit("unpublish:unmounted")
+
 	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	crashpoint.Hit("unpublish:removed")
+
+	srv.volumes.removePublished(targetPath)
+
+	if srv.mountCache != nil {
+		if err := srv.mountCache.RemovePublished(req.GetVolumeId(), targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to remove publish mount cache entry for %s: %v", targetPath, err)
+		}
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -136,13 +506,66 @@ func (srv *Server) NodeStageVolume(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	done, err := srv.startOperation(req.GetVolumeId(), req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	mntOpts, err := parseMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags(), false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volCfg, err := srv.parseVolumeAttributes(req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	stagingPath := req.GetStagingTargetPath()
 
-	if err := reconcileStagingPath(stagingPath); err != nil {
-		return nil, status.Errorf(codes.Internal,
+	commit, err := srv.beginJournaled(journal.OpStage, req.GetVolumeId(), stagingPath, "", req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer commit()
+
+	crashpoint.Hit("stage:begin")
+
+	fuseOpts, err := srv.fuseMountOptions(req.GetVolumeId(),
+		accessmode.IsWriter(req.GetVolumeCapability().GetAccessMode().GetMode()), mntOpts.fuse)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := srv.reconcileStagingPath(ctx, req.GetVolumeId(), stagingPath, fuseOpts); err != nil {
+		return nil, operationError(ctx, err,
 			"failed to reconcile mountpoint %s: %v", stagingPath, err)
 	}
 
+	crashpoint.Hit("stage:mounted")
+
+	srv.volumes.addStaged(&stagedVolume{
+		volumeID:     req.GetVolumeId(),
+		stagingPath:  stagingPath,
+		mountOptions: fuseOpts,
+		cfg:          volCfg,
+	})
+
+	if srv.mountCache != nil && volCfg.RestoreMount {
+		if err := srv.mountCache.SaveStaged(&mountcache.StagedEntry{
+			VolumeID:          req.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			MountOptions:      fuseOpts,
+			VolumeAttributes:  req.GetVolumeContext(),
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to save stage mount cache entry for %s: %v", stagingPath, err)
+		}
+
+		crashpoint.Hit("stage:cached")
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -154,13 +577,61 @@ func (srv *Server) NodeUnstageVolume(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	done, err := srv.startOperation(req.GetVolumeId(), req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	stagingPath := req.GetStagingTargetPath()
 
-	if err := mountutils.Unmount(req.GetStagingTargetPath()); err != nil {
+	commit, err := srv.beginJournaled(journal.OpUnstage, req.GetVolumeId(), stagingPath, "", req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer commit()
+
+	crashpoint.Hit("unstage:begin")
+
+	refs, err := srv.stagingReferences(stagingPath)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal,
+			"failed to find references to staging path %s: %v", stagingPath, err)
+	}
+
+	if len(refs) > 0 {
+		log.Debugf("Staging path %s is referenced by %v", stagingPath, refs)
+
+		switch srv.unstagePolicy {
+		case UnstagePolicyCleanup:
+			for _, ref := range refs {
+				log.Infof("Unpublishing %s before unstaging %s", ref, stagingPath)
+				if err := srv.cleanupPublished(ctx, req.GetVolumeId(), ref); err != nil {
+					return nil, operationError(ctx, err, "%v", err)
+				}
+			}
+		default:
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"staging path %s is still referenced by published volumes in %v", stagingPath, refs)
+		}
+	}
+
+	if err := srv.fuseMounter.unmount(ctx, req.GetVolumeId(), stagingPath); err != nil {
+		return nil, operationError(ctx, err,
 			"failed to unmount %s: %v", stagingPath, err)
 	}
 
+	crashpoint.Hit("unstage:unmounted")
+
+	srv.volumes.removeStaged(stagingPath)
+
+	if srv.mountCache != nil {
+		if err := srv.mountCache.RemoveStaged(req.GetVolumeId()); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to remove stage mount cache entry for %s: %v", stagingPath, err)
+		}
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -168,7 +639,51 @@ func (srv *Server) NodeGetVolumeStats(
 	ctx context.Context,
 	req *csi.NodeGetVolumeStatsRequest,
 ) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := validateNodeGetVolumeStatsRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volPath := req.GetVolumePath()
+
+	mnt, err := mountutils.Classify(volPath, srv.mountExpectations(volPath))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to probe mountpoint %s: %v", volPath, err)
+	}
+
+	switch mnt.State {
+	case mountutils.StNotMounted:
+		return nil, status.Errorf(codes.NotFound, "volume path %s is not mounted", volPath)
+	case mountutils.StMounted:
+		// Continue below.
+	default:
+		// The volume is mounted, but unusable or not mounted as expected.
+		// There are no usage stats we could report, only the volume condition.
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  mnt.String(),
+			},
+		}, nil
+	}
+
+	usage, err := getVolumeUsage(volPath)
+	if err != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("failed to get volume stats: %v", err),
+			},
+		}, nil
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: usage,
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  fmt.Sprintf("volume path %s is in %s state", volPath, mnt.State),
+		},
+	}, nil
 }
 
 func (srv *Server) NodeExpandVolume(
@@ -200,24 +715,10 @@ func validateNodePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
 	}
 
 	// We're not checking for staging target path, as older versions
-	// of the driver didn't support STAGE_UNSTAGE_VOLUME capability.
-
-	if req.GetVolumeCapability().GetAccessMode().GetMode() !=
-		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
-		return fmt.Errorf("volume access mode must be ReadOnlyMany")
-	}
-
-	if volCtx := req.GetVolumeContext(); len(volCtx) > 0 {
-		unsupportedVolumeParams := []string{"hash", "tag"}
-
-		for _, volParam := range unsupportedVolumeParams {
-			if _, ok := volCtx[volParam]; ok {
-				return fmt.Errorf("volume parameter %s is not supported, please use clientConfig instead", volParam)
-			}
-		}
-	}
+	// of the driver didn't support STAGE_UNSTAGE_VOLUME capability,
+	// and ephemeral volumes are never staged.
 
-	return nil
+	return accessmode.Validate(req.GetVolumeCapability().GetAccessMode().GetMode())
 }
 
 func validateNodeUnpublishVolumeRequest(req *csi.NodeUnpublishVolumeRequest) error {
@@ -253,19 +754,20 @@ func validateNodeStageVolumeRequest(req *csi.NodeStageVolumeRequest) error {
 		return errors.New("volume staging target path missing in request")
 	}
 
-	if req.GetVolumeCapability().GetAccessMode().GetMode() !=
-		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
-		return fmt.Errorf("volume access mode must be ReadOnlyMany")
+	if err := accessmode.Validate(req.GetVolumeCapability().GetAccessMode().GetMode()); err != nil {
+		return err
 	}
 
-	if volCtx := req.GetVolumeContext(); len(volCtx) > 0 {
-		unsupportedVolumeParams := []string{"hash", "tag"}
+	return nil
+}
 
-		for _, volParam := range unsupportedVolumeParams {
-			if _, ok := volCtx[volParam]; ok {
-				return fmt.Errorf("volume parameter %s is not supported", volParam)
-			}
-		}
+func validateNodeGetVolumeStatsRequest(req *csi.NodeGetVolumeStatsRequest) error {
+	if req.GetVolumeId() == "" {
+		return errors.New("volume ID missing in request")
+	}
+
+	if req.GetVolumePath() == "" {
+		return errors.New("volume path missing in request")
 	}
 
 	return nil
@@ -0,0 +1,168 @@
+package node
+
+import (
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+// DiscoverVolumes rebuilds the list of staged and published volumes from
+// kubelet's vol_data.json files, and restores them like RestoreMounts does.
+// Volumes that are already tracked (e.g. restored from the mount cache)
+// are skipped. It is a no-op if volume discovery was not enabled in Opts.
+//
+// Kubelet doesn't store mount flags nor volume attributes. Mount flags are
+// recovered from the mount table if the volume is still mounted, otherwise
+// the volume is restored with default flags. Default volume attributes
+// are used, except for the publish mode, which is recovered from the mount
+// table too.
+func (srv *Server) DiscoverVolumes() {
+	if !srv.discoverVolumes {
+		return
+	}
+
+	inv, err := kubeletstate.Scan(srv.kubeletRoot, srv.driverName)
+	if err != nil {
+		log.Errorf("Failed to read some of kubelet's volume data: %v", err)
+	}
+	if inv == nil {
+		return
+	}
+
+	log.Infof("Discovered %d staged and %d published volumes in %s",
+		len(inv.Staged), len(inv.Published), srv.kubeletRoot)
+
+	for i := range inv.Staged {
+		kv := &inv.Staged[i]
+		if srv.volumes.tracks(kv.StagingPath) {
+			continue
+		}
+
+		volumeID := kv.VolData.VolumeHandle
+		mnt := discoveredMountInfo(kv.StagingPath)
+
+		opts, err := srv.fuseMountOptions(volumeID, srv.hasBackingDirOf(volumeID), recoveredFuseOptions(mnt))
+		if err != nil {
+			log.Errorf("Failed to restore discovered staged volume %s: %v", volumeID, err)
+			continue
+		}
+
+		srv.restoreStagedVolume(&stagedVolume{
+			volumeID:     volumeID,
+			stagingPath:  kv.StagingPath,
+			mountOptions: opts,
+			cfg:          volumeattrs.Default(),
+		})
+	}
+
+	for i := range inv.Published {
+		kv := &inv.Published[i]
+		if srv.volumes.tracks(kv.TargetPath) {
+			continue
+		}
+
+		volumeID := kv.VolData.VolumeHandle
+		mnt := discoveredMountInfo(kv.TargetPath)
+
+		v := &publishedVolume{
+			volumeID:   volumeID,
+			targetPath: kv.TargetPath,
+			ephemeral:  kv.VolData.IsEphemeral(),
+			cfg:        volumeattrs.Default(),
+		}
+
+		if v.ephemeral {
+			vfs := recoveredVfsFlags(mnt)
+			writable := srv.hasBackingDirOf(volumeID) && !containsString(vfs, "ro")
+
+			opts, err := srv.fuseMountOptions(volumeID, writable, append(vfs, recoveredFuseOptions(mnt)...))
+			if err != nil {
+				log.Errorf("Failed to restore discovered ephemeral volume %s: %v", volumeID, err)
+				continue
+			}
+
+			v.mountOptions = opts
+		} else {
+			if kv.StagingPath == "" {
+				log.Warningf("Not restoring discovered published volume %s in %s: its staging path is unknown",
+					volumeID, kv.TargetPath)
+				continue
+			}
+
+			v.stagingPath = kv.StagingPath
+			v.mountOptions = recoveredVfsFlags(mnt)
+
+			if mnt != nil && strings.Contains(mnt.Optional, "master:") {
+				v.cfg.PublishMode = volumeattrs.PublishModeRbindSlave
+			}
+		}
+
+		srv.restorePublishedVolume(v)
+	}
+}
+
+// discoveredMountInfo returns mount table entry of mountpoint,
+// or nil if it's not mounted or the mount table cannot be read.
+func discoveredMountInfo(mountpoint string) *mountinfo.Info {
+	mnt, err := mountutils.GetMountInfo(mountpoint)
+	if err != nil {
+		log.Errorf("Failed to read mount table entry of %s: %v", mountpoint, err)
+		return nil
+	}
+
+	if mnt != nil && mnt.FSType != dummyFuseFSType {
+		return nil
+	}
+
+	return mnt
+}
+
+// recoveredFuseOptions returns FUSE options of the dummy-fuse mount mnt that
+// would be accepted by parseMountFlags.
+func recoveredFuseOptions(mnt *mountinfo.Info) []string {
+	if mnt == nil {
+		return nil
+	}
+
+	var opts []string
+	for _, opt := range strings.Split(mnt.VFSOptions, ",") {
+		key, _, _ := strings.Cut(opt, "=")
+		if _, ok := fuseOptions[key]; ok {
+			opts = append(opts, opt)
+		}
+	}
+
+	return opts
+}
+
+// recoveredVfsFlags returns VFS flags of mnt that would be accepted by parseMountFlags.
+// nosuid and nodev are left out, as dummy-fuse is always mounted with them.
+func recoveredVfsFlags(mnt *mountinfo.Info) []string {
+	if mnt == nil {
+		return nil
+	}
+
+	var flags []string
+	for _, opt := range strings.Split(mnt.Options, ",") {
+		if opt == "nosuid" || opt == "nodev" {
+			continue
+		}
+
+		if vf, ok := vfsFlags[opt]; ok && vf.set {
+			flags = append(flags, opt)
+		}
+	}
+
+	return flags
+}
+
+// hasBackingDirOf returns true if volumeID has a backing directory,
+// i.e. it was mounted with a writer access mode.
+func (srv *Server) hasBackingDirOf(volumeID string) bool {
+	return pathExists(srv.volumeBackingDir(volumeID))
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"context"
+	"path"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/accessmode"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/crashpoint"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountcache"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Volume context key set by kubelet for CSI ephemeral inline volumes.
+	// Requires podInfoOnMount to be enabled in the CSIDriver object.
+	ephemeralVolumeContextKey = "csi.storage.k8s.io/ephemeral"
+)
+
+func isEphemeralVolume(volCtx map[string]string) bool {
+	return volCtx[ephemeralVolumeContextKey] == "true"
+}
+
+// isEphemeralTarget returns true if targetPath is the target path of an ephemeral
+// volume. If the volume is not tracked (e.g. the node plugin was restarted without
+// restoring mounts), kubelet's volume metadata stored next to targetPath is checked.
+func (srv *Server) isEphemeralTarget(targetPath string) bool {
+	if v := srv.volumes.getPublished(targetPath); v != nil {
+		return v.ephemeral
+	}
+
+	volData, err := kubeletstate.ReadVolData(path.Dir(targetPath))
+	if err != nil {
+		return false
+	}
+
+	return volData.IsEphemeral()
+}
+
+// publishEphemeralVolume mounts dummy-fuse directly into the target path.
+// Ephemeral volumes are not staged.
+func (srv *Server) publishEphemeralVolume(
+	ctx context.Context,
+	req *csi.NodePublishVolumeRequest,
+	mntOpts *mountOptions,
+	volCfg *volumeattrs.Config,
+) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+
+	// Kubelet always requests ReadWriteOnce access mode for inline
+	// volumes, so they are writable unless the volume is read-only.
+	fuseOpts, err := srv.fuseMountOptions(req.GetVolumeId(),
+		accessmode.IsWriter(req.GetVolumeCapability().GetAccessMode().GetMode()) && !req.GetReadonly(),
+		mntOpts.all())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := srv.reconcileEphemeralPath(ctx, req.GetVolumeId(), targetPath, fuseOpts); err != nil {
+		return nil, operationError(ctx, err,
+			"failed to reconcile mountpoint %s: %v", targetPath, err)
+	}
+
+	crashpoint.Hit("publish:mounted")
+
+	srv.volumes.addPublished(&publishedVolume{
+		volumeID:     req.GetVolumeId(),
+		targetPath:   targetPath,
+		ephemeral:    true,
+		mountOptions: fuseOpts,
+		cfg:          volCfg,
+	})
+
+	if srv.mountCache != nil && volCfg.RestoreMount {
+		if err := srv.mountCache.SavePublished(&mountcache.PublishedEntry{
+			VolumeID:         req.GetVolumeId(),
+			TargetPath:       targetPath,
+			Ephemeral:        true,
+			MountOptions:     fuseOpts,
+			VolumeAttributes: req.GetVolumeContext(),
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to save publish mount cache entry for %s: %v", targetPath, err)
+		}
+
+		crashpoint.Hit("publish:cached")
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// reconcilePublishedVolume reconciles the target path of a published volume.
+func (srv *Server) reconcilePublishedVolume(ctx context.Context, v *publishedVolume) error {
+	if v.ephemeral {
+		return srv.reconcileEphemeralPath(ctx, v.volumeID, v.targetPath, v.mountOptions)
+	}
+
+	return reconcilePublishPath(ctx, v.stagingPath, v.targetPath, v.cfg.PublishMode, v.mountOptions)
+}
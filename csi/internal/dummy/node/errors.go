@@ -0,0 +1,26 @@
+package node
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationError returns gRPC status error for a failed mount operation.
+// If the operation failed because the request context expired or was
+// canceled (e.g. a hung mount command was killed), DeadlineExceeded
+// or Canceled is returned. All other errors are Internal.
+func operationError(ctx context.Context, err error, format string, args ...interface{}) error {
+	code := codes.Internal
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		code = codes.Canceled
+	}
+
+	return status.Errorf(code, format, args...)
+}
@@ -0,0 +1,199 @@
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeFuseMounter mounts FUSE sessions served by the test process itself,
+// standing in for dummy-fuse. The file system has only an empty root directory.
+// Its mounts are of the same type as dummy-fuse mounts, and become corrupted
+// once the process that mounted them exits, just like dummy-fuse mounts do
+// when the node plugin container is killed.
+//
+// Each session is served by its own goroutine until the session is unmounted.
+// Tests must unmount everything the mounter mounted and then call wait, so that
+// no session outlives the test.
+type fakeFuseMounter struct {
+	sessions sync.WaitGroup
+}
+
+var _ fuseMounter = (*fakeFuseMounter)(nil)
+
+func (m *fakeFuseMounter) mount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	// The session is opened without os.OpenFile, which would register it in
+	// the runtime's netpoller. /dev/fuse reports EPOLLERR until the session
+	// is mounted, and the netpoller would then refuse reads from it for good.
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open FUSE device: %v", err)
+	}
+
+	if err = mountFuseSession(mountpoint, fd, opts); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to mount FUSE session: %v", err)
+	}
+
+	m.sessions.Add(1)
+	go func() {
+		defer m.sessions.Done()
+		serveFakeFuse(os.NewFile(uintptr(fd), "/dev/fuse"))
+	}()
+
+	return nil
+}
+
+// wait waits until all sessions are unmounted and their goroutines have exited.
+func (m *fakeFuseMounter) wait(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		m.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for FUSE sessions to be unmounted")
+	}
+}
+
+func (m *fakeFuseMounter) unmount(ctx context.Context, volumeID, mountpoint string) error {
+	return mountutils.UnmountEscalating(ctx, mountpoint, 0)
+}
+
+// Subset of the FUSE kernel protocol, see include/uapi/linux/fuse.h.
+
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseStatfs      = 17
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseBatchForget = 42
+
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 31
+
+	fuseInHeaderSize  = 40
+	fuseOutHeaderSize = 16
+	fuseInitOutSize   = 64
+	fuseAttrOutSize   = 104
+	fuseOpenOutSize   = 16
+	fuseStatfsOutSize = 80
+
+	fakeFuseMaxWrite = 128 * 1024
+	fakeFuseRootMode = unix.S_IFDIR | 0755
+)
+
+// serveFakeFuse serves FUSE requests on session until it's unmounted.
+func serveFakeFuse(session *os.File) {
+	defer session.Close()
+
+	// The kernel refuses reads into buffers that can't fit a write request.
+	buf := make([]byte, fakeFuseMaxWrite+4096)
+
+	for {
+		n, err := session.Read(buf)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				// The request was interrupted before we read it.
+				continue
+			}
+
+			// ENODEV once the file system is unmounted.
+			return
+		}
+
+		if n < fuseInHeaderSize {
+			return
+		}
+
+		reply := handleFakeFuseRequest(buf[:n])
+		if reply == nil {
+			continue
+		}
+
+		if _, err = session.Write(reply); err != nil && !errors.Is(err, unix.ENOENT) {
+			return
+		}
+	}
+}
+
+// handleFakeFuseRequest returns the reply to the request in req,
+// or nil if the request doesn't take one.
+func handleFakeFuseRequest(req []byte) []byte {
+	var (
+		le     = binary.LittleEndian
+		opcode = le.Uint32(req[4:])
+		unique = le.Uint64(req[8:])
+		in     = req[fuseInHeaderSize:]
+	)
+
+	var (
+		out   []byte
+		errno unix.Errno
+	)
+
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		return nil
+
+	case fuseInit:
+		out = make([]byte, fuseInitOutSize)
+		le.PutUint32(out[0:], fuseKernelVersion)
+		le.PutUint32(out[4:], fuseKernelMinorVersion)
+		le.PutUint32(out[8:], le.Uint32(in[8:])) // max_readahead
+		le.PutUint32(out[20:], fakeFuseMaxWrite)
+
+	case fuseGetattr:
+		// Lookups always fail, the root is the only inode there is.
+		// Attributes are not cached, so that accessing the mount fails
+		// as soon as the process serving it is gone.
+		out = make([]byte, fuseAttrOutSize)
+		le.PutUint64(out[16:], 1) // ino
+		le.PutUint32(out[16+60:], fakeFuseRootMode)
+		le.PutUint32(out[16+64:], 2)    // nlink
+		le.PutUint32(out[16+80:], 4096) // blksize
+
+	case fuseStatfs:
+		out = make([]byte, fuseStatfsOutSize)
+		le.PutUint32(out[40:], 4096) // bsize
+		le.PutUint32(out[44:], 255)  // namelen
+		le.PutUint32(out[48:], 4096) // frsize
+
+	case fuseOpendir:
+		out = make([]byte, fuseOpenOutSize)
+
+	case fuseReaddir, fuseReleasedir:
+		// Empty reply, i.e. no directory entries.
+
+	case fuseLookup:
+		errno = unix.ENOENT
+
+	default:
+		errno = unix.ENOSYS
+	}
+
+	reply := make([]byte, fuseOutHeaderSize+len(out))
+	le.PutUint32(reply[0:], uint32(len(reply)))
+	le.PutUint32(reply[4:], uint32(-int32(errno)))
+	le.PutUint64(reply[8:], unique)
+	copy(reply[fuseOutHeaderSize:], out)
+
+	return reply
+}
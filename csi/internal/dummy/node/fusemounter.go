@@ -0,0 +1,154 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fdstore"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountproxy"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+type (
+	// fuseMounter mounts and unmounts dummy-fuse file-systems.
+	fuseMounter interface {
+		// mount mounts dummy-fuse into mountpoint. opts are mount options
+		// validated by parseMountFlags.
+		mount(ctx context.Context, volumeID, mountpoint string, opts []string) error
+		unmount(ctx context.Context, volumeID, mountpoint string) error
+	}
+
+	// fuseReviver is implemented by fuseMounters that are able to start
+	// a new FUSE daemon for an existing FUSE connection.
+	fuseReviver interface {
+		// revive starts a new FUSE daemon for volume volumeID, with mount
+		// options opts. Returns false if there's no FUSE connection to revive.
+		revive(ctx context.Context, volumeID string, opts []string) (bool, error)
+	}
+
+	// localFuseMounter runs dummy-fuse directly in the node plugin container,
+	// as supervised child processes. The FUSE processes share the lifetime
+	// of the container.
+	localFuseMounter struct {
+		sup *fuseSupervisor
+	}
+
+	// proxyFuseMounter delegates mounting to dummy-fuse-mount-proxy,
+	// which owns the FUSE processes and runs in a separate container.
+	proxyFuseMounter struct {
+		c *mountproxy.Client
+	}
+
+	// fdStoreFuseMounter opens the /dev/fuse session itself, mounts it and
+	// then passes the session fd to dummy-fuse. The fd is also registered
+	// with the fd keeper, which keeps the FUSE connection alive even if the
+	// dummy-fuse process dies, and lets us hand the connection over to
+	// a new dummy-fuse process.
+	fdStoreFuseMounter struct {
+		c *fdstore.Client
+	}
+)
+
+var (
+	_ fuseMounter = (*localFuseMounter)(nil)
+	_ fuseMounter = (*proxyFuseMounter)(nil)
+	_ fuseMounter = (*fdStoreFuseMounter)(nil)
+	_ fuseReviver = (*fdStoreFuseMounter)(nil)
+)
+
+func (m *localFuseMounter) mount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	return m.sup.start(ctx, volumeID, mountpoint, opts)
+}
+
+func (m *localFuseMounter) unmount(ctx context.Context, volumeID, mountpoint string) error {
+	// Don't restart dummy-fuse once it exits after the unmount.
+	m.sup.stop(mountpoint)
+
+	if err := mountutils.UnmountEscalating(ctx, mountpoint, 0); err != nil {
+		return err
+	}
+
+	m.sup.waitExited(mountpoint)
+
+	return nil
+}
+
+func (m *proxyFuseMounter) mount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	_, err := m.c.Mount(ctx, &mountproxy.MountRequest{
+		VolumeID:   volumeID,
+		Mountpoint: mountpoint,
+		Options:    opts,
+	})
+
+	return err
+}
+
+func (m *proxyFuseMounter) unmount(ctx context.Context, volumeID, mountpoint string) error {
+	_, err := m.c.Unmount(ctx, &mountproxy.UnmountRequest{
+		Mountpoint: mountpoint,
+	})
+
+	return err
+}
+
+func (m *fdStoreFuseMounter) mount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	session, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open FUSE device: %v", err)
+	}
+	defer session.Close()
+
+	if err = mountFuseSession(mountpoint, int(session.Fd()), opts); err != nil {
+		return fmt.Errorf("failed to mount FUSE session: %v", err)
+	}
+
+	if err = m.c.Store(volumeID, int(session.Fd())); err != nil {
+		if unmountErr := mountutils.Unmount(ctx, mountpoint, 0); unmountErr != nil {
+			log.Errorf("Failed to unmount %s after failing to store FUSE session fd: %v", mountpoint, unmountErr)
+		}
+
+		return fmt.Errorf("failed to store FUSE session fd: %v", err)
+	}
+
+	return mountDummyFuseSession(ctx, session, opts)
+}
+
+func (m *fdStoreFuseMounter) unmount(ctx context.Context, volumeID, mountpoint string) error {
+	if err := mountutils.UnmountEscalating(ctx, mountpoint, 0); err != nil {
+		return err
+	}
+
+	if err := m.c.Drop(volumeID); err != nil {
+		return fmt.Errorf("failed to release FUSE session fd: %w", err)
+	}
+
+	return nil
+}
+
+// revive retrieves the FUSE session fd of volumeID from the fd keeper
+// and starts a new dummy-fuse process serving it.
+//
+// Note that libfuse expects to receive FUSE_INIT as the first request
+// on a new session. The kernel has already completed the init handshake
+// with the previous dummy-fuse process however, so whether the revived
+// daemon is able to serve requests depends on the libfuse version.
+func (m *fdStoreFuseMounter) revive(ctx context.Context, volumeID string, opts []string) (bool, error) {
+	session, err := m.c.Retrieve(volumeID)
+	if err != nil {
+		if errors.Is(err, fdstore.ErrNotFound) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to retrieve FUSE session fd: %v", err)
+	}
+	defer session.Close()
+
+	if err = mountDummyFuseSession(ctx, session, opts); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
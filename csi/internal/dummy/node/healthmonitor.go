@@ -0,0 +1,196 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+type (
+	// mountHealth records the last observed state of a mountpoint.
+	mountHealth struct {
+		volumeID string
+		state    mountutils.State
+		since    time.Time
+	}
+
+	// healthMonitor periodically probes all staged and published
+	// mountpoints and records their state transitions.
+	healthMonitor struct {
+		interval time.Duration
+		autoHeal bool
+
+		mu     sync.Mutex
+		health map[string]*mountHealth // Keyed by mountpoint path.
+	}
+)
+
+func newHealthMonitor(interval time.Duration, autoHeal bool) *healthMonitor {
+	return &healthMonitor{
+		interval: interval,
+		autoHeal: autoHeal,
+		health:   make(map[string]*mountHealth),
+	}
+}
+
+// record stores the new state of mountpoint and logs the transition if the state has changed.
+func (m *healthMonitor) record(volumeID, mountpoint string, state mountutils.State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.health[mountpoint]
+	if !ok {
+		m.health[mountpoint] = &mountHealth{
+			volumeID: volumeID,
+			state:    state,
+			since:    time.Now(),
+		}
+
+		log.Infof("Health monitor: volume %s mountpoint %s is in %s state", volumeID, mountpoint, state)
+		return
+	}
+
+	if h.state == state {
+		return
+	}
+
+	log.Infof("Health monitor: volume %s mountpoint %s changed state %s -> %s after %s",
+		volumeID, mountpoint, h.state, state, time.Since(h.since).Round(time.Second))
+
+	h.state = state
+	h.since = time.Now()
+}
+
+// forget removes all records for mountpoints that are not in keep.
+func (m *healthMonitor) forget(keep map[string]struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for mountpoint := range m.health {
+		if _, ok := keep[mountpoint]; !ok {
+			delete(m.health, mountpoint)
+		}
+	}
+}
+
+// check probes mountpoint, records its state and, if auto-heal is enabled
+// and the mountpoint is corrupted, tries to remount it with reconcileF.
+// If healUnmounted is set, mountpoints that are not mounted are remounted too.
+func (m *healthMonitor) check(volumeID, mountpoint string, healUnmounted bool, reconcileF func() error) {
+	state, err := mountutils.GetState(mountpoint)
+	if err != nil {
+		log.Errorf("Health monitor: failed to probe mountpoint %s of volume %s: %v", mountpoint, volumeID, err)
+	}
+
+	m.record(volumeID, mountpoint, state)
+
+	if state == mountutils.StCorrupted {
+		if c, err := mountutils.Classify(mountpoint, nil); err == nil {
+			log.Warningf("Health monitor: volume %s: %s", volumeID, c)
+		}
+	}
+
+	needsHeal := state == mountutils.StCorrupted || (healUnmounted && state == mountutils.StNotMounted)
+	if !needsHeal || !m.autoHeal {
+		return
+	}
+
+	log.Infof("Health monitor: attempting to heal volume %s in %s", volumeID, mountpoint)
+
+	if err := reconcileF(); err != nil {
+		log.Errorf("Health monitor: failed to heal volume %s in %s: %v", volumeID, mountpoint, err)
+		return
+	}
+
+	if state, err = mountutils.GetState(mountpoint); err == nil {
+		m.record(volumeID, mountpoint, state)
+	}
+}
+
+// runHealthMonitor probes all tracked volumes every m.interval. It never returns.
+func (srv *Server) runHealthMonitor(m *healthMonitor) {
+	log.Infof("Starting mount health monitor with interval %s (auto-heal: %t)", m.interval, m.autoHeal)
+
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+
+	for range t.C {
+		srv.checkVolumesHealth(m)
+	}
+}
+
+func (srv *Server) checkVolumesHealth(m *healthMonitor) {
+	staged, published := srv.volumes.snapshot()
+	seen := make(map[string]struct{}, len(staged)+len(published))
+
+	// Staging paths are checked first, so that published volumes
+	// are healed only after their source mount was restored.
+
+	for i := range staged {
+		v := &staged[i]
+		if !v.cfg.HealthCheck {
+			continue
+		}
+
+		seen[v.stagingPath] = struct{}{}
+
+		srv.tryCheck(m, v.volumeID, v.stagingPath, false, func() error {
+			return srv.reconcileStagingPath(context.Background(), v.volumeID, v.stagingPath, v.mountOptions)
+		})
+	}
+
+	for i := range published {
+		v := &published[i]
+		if !v.cfg.HealthCheck {
+			continue
+		}
+
+		seen[v.targetPath] = struct{}{}
+
+		srv.tryCheck(m, v.volumeID, v.targetPath, false, func() error {
+			return srv.reconcilePublishedVolume(context.Background(), v)
+		})
+	}
+
+	m.forget(seen)
+}
+
+// tryCheck runs health check of mountpoint, unless there's a node RPC in progress
+// for the same volume or path. The check is then skipped until the next round.
+func (srv *Server) tryCheck(
+	m *healthMonitor,
+	volumeID, mountpoint string,
+	healUnmounted bool,
+	reconcileF func() error,
+) {
+	done, err := srv.startOperation(volumeID, mountpoint)
+	if err != nil {
+		log.Debugf("Skipping health check of %s: %v", mountpoint, err)
+		return
+	}
+	defer done()
+
+	// The volume may have been unstaged or unpublished since the caller
+	// took its snapshot of tracked volumes. Don't remount what kubelet
+	// has just released.
+	if !srv.volumes.tracksVolume(volumeID, mountpoint) {
+		log.Debugf("Skipping health check of %s: volume %s is no longer tracked", mountpoint, volumeID)
+		return
+	}
+
+	m.check(volumeID, mountpoint, healUnmounted, reconcileF)
+}
+
+// StartHealthMonitor starts a background goroutine that periodically
+// probes all staged and published volumes. It is a no-op if the health
+// monitor was not enabled in Opts.
+func (srv *Server) StartHealthMonitor() {
+	if srv.healthMonitor == nil {
+		return
+	}
+
+	go srv.runHealthMonitor(srv.healthMonitor)
+}
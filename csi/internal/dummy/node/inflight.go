@@ -0,0 +1,88 @@
+package node
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// inFlight tracks in-flight operations, keyed by volume IDs and paths.
+// As per CSI spec, a request that would run concurrently with another
+// operation on the same volume should be aborted.
+type inFlight struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		keys: make(map[string]struct{}),
+	}
+}
+
+func volumeKey(volumeID string) string { return "volume:" + volumeID }
+func pathKey(p string) string          { return "path:" + p }
+
+// tryAcquire acquires all keys at once. It returns false, acquiring none
+// of the keys, if any of them is already held by another operation.
+func (f *inFlight) tryAcquire(keys ...string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, k := range keys {
+		if _, ok := f.keys[k]; ok {
+			return false
+		}
+	}
+
+	for _, k := range keys {
+		f.keys[k] = struct{}{}
+	}
+
+	return true
+}
+
+func (f *inFlight) release(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, k := range keys {
+		delete(f.keys, k)
+	}
+}
+
+// startOperation marks an operation on volumeID and paths as in-flight. It returns
+// codes.Aborted error if another operation on the volume or any of the paths
+// is in progress. Otherwise, the returned function must be called once
+// the operation is done.
+func (srv *Server) startOperation(volumeID string, paths ...string) (func(), error) {
+	keys := make([]string, 0, len(paths)+1)
+	keys = append(keys, volumeKey(volumeID))
+	for _, p := range paths {
+		keys = append(keys, pathKey(p))
+	}
+
+	if !srv.inFlight.tryAcquire(keys...) {
+		return nil, status.Errorf(codes.Aborted,
+			"an operation on volume %s or paths %v is already in progress", volumeID, paths)
+	}
+
+	return func() { srv.inFlight.release(keys...) }, nil
+}
+
+// startPathOperation is like startOperation, for operations on paths whose
+// volume is not known, e.g. orphaned mounts.
+func (srv *Server) startPathOperation(paths ...string) (func(), error) {
+	keys := make([]string, 0, len(paths))
+	for _, p := range paths {
+		keys = append(keys, pathKey(p))
+	}
+
+	if !srv.inFlight.tryAcquire(keys...) {
+		return nil, status.Errorf(codes.Aborted,
+			"an operation on paths %v is already in progress", paths)
+	}
+
+	return func() { srv.inFlight.release(keys...) }, nil
+}
@@ -0,0 +1,245 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStartOperationConflicts(t *testing.T) {
+	srv := &Server{inFlight: newInFlight()}
+
+	done, err := srv.startOperation("vol-1", "/staging/vol-1")
+	if err != nil {
+		t.Fatalf("startOperation failed: %v", err)
+	}
+
+	// Same volume, different path.
+	if _, err := srv.startOperation("vol-1", "/target/a"); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected Aborted for the same volume, got %v", err)
+	}
+
+	// Different volume, same path.
+	if _, err := srv.startOperation("vol-2", "/staging/vol-1"); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected Aborted for the same path, got %v", err)
+	}
+
+	// Path only.
+	if _, err := srv.startPathOperation("/staging/vol-1"); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected Aborted for the same path, got %v", err)
+	}
+
+	// A rejected request must not hold any of its keys.
+	done2, err := srv.startOperation("vol-2", "/target/b")
+	if err != nil {
+		t.Fatalf("startOperation of an unrelated volume failed: %v", err)
+	}
+	done2()
+
+	done()
+
+	done, err = srv.startOperation("vol-1", "/staging/vol-1")
+	if err != nil {
+		t.Fatalf("startOperation after release failed: %v", err)
+	}
+	done()
+
+	if n := len(srv.inFlight.keys); n != 0 {
+		t.Fatalf("expected all keys to be released, %d still held", n)
+	}
+}
+
+func TestStartOperationConcurrent(t *testing.T) {
+	const (
+		workers    = 32
+		iterations = 500
+		volumes    = 3
+		paths      = 4
+	)
+
+	srv := &Server{inFlight: newInFlight()}
+
+	// Number of operations currently holding each volume and path.
+	var (
+		volHolders  [volumes]int32
+		pathHolders [paths]int32
+		succeeded   int64
+		aborted     int64
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < iterations; i++ {
+				// Overlapping keys: each volume is used with several paths,
+				// and each path with several volumes.
+				v := (w + i) % volumes
+				p := (w * i) % paths
+
+				done, err := srv.startOperation(fmt.Sprintf("vol-%d", v), fmt.Sprintf("/mnt/%d", p))
+				if err != nil {
+					if status.Code(err) != codes.Aborted {
+						t.Errorf("expected Aborted, got %v", err)
+						return
+					}
+					atomic.AddInt64(&aborted, 1)
+					continue
+				}
+
+				if n := atomic.AddInt32(&volHolders[v], 1); n != 1 {
+					t.Errorf("volume vol-%d held by %d operations at once", v, n)
+				}
+				if n := atomic.AddInt32(&pathHolders[p], 1); n != 1 {
+					t.Errorf("path /mnt/%d held by %d operations at once", p, n)
+				}
+
+				runtime.Gosched()
+
+				atomic.AddInt32(&volHolders[v], -1)
+				atomic.AddInt32(&pathHolders[p], -1)
+
+				done()
+				atomic.AddInt64(&succeeded, 1)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	if succeeded == 0 {
+		t.Fatal("no operation succeeded")
+	}
+
+	t.Logf("%d operations succeeded, %d aborted", succeeded, aborted)
+
+	if n := len(srv.inFlight.keys); n != 0 {
+		t.Fatalf("expected all keys to be released, %d still held: %v", n, srv.inFlight.keys)
+	}
+}
+
+// blockingFuseMounter counts mounts, and blocks each of them until release is closed.
+type blockingFuseMounter struct {
+	fuseMounter
+
+	mounts  int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingFuseMounter) mount(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	atomic.AddInt32(&m.mounts, 1)
+	m.entered <- struct{}{}
+	<-m.release
+
+	return m.fuseMounter.mount(ctx, volumeID, mountpoint, opts)
+}
+
+func TestConcurrentStagePublish(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE is not available")
+	}
+
+	const calls = 16
+
+	e := newCrashTestEnv(t.TempDir(), false)
+	t.Cleanup(func() { e.teardown(t) })
+	e.setup(t)
+
+	srv := e.newServer(t)
+	fm := &blockingFuseMounter{
+		fuseMounter: e.fuse,
+		entered:     make(chan struct{}, calls),
+		release:     make(chan struct{}),
+	}
+	srv.fuseMounter = fm
+
+	// Don't leave the mounting call blocked if the test fails early.
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(fm.release) }) }
+	t.Cleanup(release)
+
+	var (
+		ctx     = context.Background()
+		start   = make(chan struct{})
+		results = make(chan error, calls)
+	)
+
+	for i := 0; i < calls; i++ {
+		go func(stage bool) {
+			<-start
+
+			var err error
+			if stage {
+				_, err = srv.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+					VolumeId:          crashTestVolumeID,
+					StagingTargetPath: e.stagingPath,
+					VolumeCapability:  e.volumeCapability(),
+					VolumeContext:     e.volumeContext(),
+				})
+			} else {
+				_, err = srv.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+					VolumeId:          crashTestVolumeID,
+					StagingTargetPath: e.stagingPath,
+					TargetPath:        e.targetPath,
+					VolumeCapability:  e.volumeCapability(),
+					VolumeContext:     e.volumeContext(),
+				})
+			}
+
+			results <- err
+		}(i%2 == 0)
+	}
+
+	close(start)
+
+	// One call gets to mount the volume, and is held there until
+	// all the other calls have returned.
+	select {
+	case <-fm.entered:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for a call to mount the volume")
+	}
+
+	for i := 0; i < calls-1; i++ {
+		select {
+		case err := <-results:
+			if status.Code(err) != codes.Aborted {
+				t.Errorf("expected Aborted, got %v", err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatal("timed out waiting for concurrent calls to return")
+		}
+	}
+
+	release()
+
+	if err := <-results; err != nil {
+		t.Fatalf("expected the call that mounted the volume to succeed, got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&fm.mounts); n != 1 {
+		t.Fatalf("expected the volume to be mounted once, got %d mounts", n)
+	}
+
+	e.checkMount(t, e.stagingPath, true)
+
+	if n := len(srv.inFlight.keys); n != 0 {
+		t.Fatalf("expected all keys to be released, %d still held: %v", n, srv.inFlight.keys)
+	}
+}
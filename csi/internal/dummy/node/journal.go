@@ -0,0 +1,168 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/journal"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// beginJournaled records a node operation in the journal, before it changes
+// anything on the node. The returned function commits the record and must be
+// called once the operation returns, whether it succeeded or not: failed
+// operations are retried by kubelet, only interrupted ones need replaying.
+func (srv *Server) beginJournaled(op journal.Op, volumeID, stagingPath, targetPath string, req protoadapt.MessageV1) (func(), error) {
+	if srv.journal == nil {
+		return func() {}, nil
+	}
+
+	b, err := protojson.Marshal(stripSecrets(req))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s request: %v", op, err)
+	}
+
+	e, err := srv.journal.Begin(&journal.Record{
+		Op:          op,
+		VolumeID:    volumeID,
+		StagingPath: stagingPath,
+		TargetPath:  targetPath,
+		Request:     b,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := e.Commit(); err != nil {
+			log.Errorf("Failed to commit %s of volume %s: %v", op, volumeID, err)
+		}
+	}, nil
+}
+
+// stripSecrets returns a copy of req without secrets, so that they
+// are never written into the journal. dummy-fuse doesn't use them.
+func stripSecrets(req protoadapt.MessageV1) proto.Message {
+	m := proto.Clone(protoadapt.MessageV2Of(req))
+
+	switch r := protoadapt.MessageV1Of(m).(type) {
+	case *csi.NodeStageVolumeRequest:
+		r.Secrets = nil
+	case *csi.NodePublishVolumeRequest:
+		r.Secrets = nil
+	}
+
+	return m
+}
+
+// unmarshalRequest unmarshals a journaled request into req.
+func unmarshalRequest(b []byte, req protoadapt.MessageV1) error {
+	return protojson.Unmarshal(b, protoadapt.MessageV2Of(req))
+}
+
+// ReplayJournal finishes node operations that were interrupted, e.g. because
+// the node plugin was killed in the middle of an RPC. Records are replayed
+// in the order their operations started:
+//
+//   - NodeStageVolume and NodePublishVolume are rolled forward by running
+//     them again if kubelet still has vol_data.json of the volume, i.e.
+//     it still wants the volume mounted. Otherwise, they are rolled back
+//     by running NodeUnstageVolume and NodeUnpublishVolume respectively.
+//   - NodeUnstageVolume and NodeUnpublishVolume are always rolled forward.
+//
+// Node RPCs are idempotent, so replaying an operation that managed to finish
+// before being interrupted is harmless. Records of operations that fail to be
+// replayed are kept, and replayed again on next startup.
+//
+// ReplayJournal must be called before RestoreMounts and before the node
+// service starts serving requests. It is a no-op if Opts.Journal is not set.
+func (srv *Server) ReplayJournal() {
+	if srv.journal == nil {
+		return
+	}
+
+	entries, err := srv.journal.Pending()
+	if err != nil {
+		log.Errorf("Failed to read journal: %v", err)
+		return
+	}
+
+	if len(entries) == 0 {
+		log.Infof("No interrupted operations in the journal")
+		return
+	}
+
+	for _, e := range entries {
+		log.Infof("Replaying interrupted %s of volume %s started at %s (seq %d)",
+			e.Op, e.VolumeID, e.StartedAt, e.Seq)
+
+		if err := srv.replay(context.TODO(), &e.Record); err != nil {
+			log.Errorf("Failed to replay %s of volume %s (seq %d): %v", e.Op, e.VolumeID, e.Seq, err)
+			continue
+		}
+
+		if err := e.Commit(); err != nil {
+			log.Errorf("Failed to commit replayed %s of volume %s: %v", e.Op, e.VolumeID, err)
+		}
+	}
+}
+
+func (srv *Server) replay(ctx context.Context, r *journal.Record) error {
+	var err error
+
+	switch r.Op {
+	case journal.OpStage:
+		if !hasVolData(r.StagingPath) {
+			log.Infof("Rolling back stage of volume %s: kubelet doesn't know about %s anymore",
+				r.VolumeID, r.StagingPath)
+			_, err = srv.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          r.VolumeID,
+				StagingTargetPath: r.StagingPath,
+			})
+			break
+		}
+
+		req := &csi.NodeStageVolumeRequest{}
+		if err = unmarshalRequest(r.Request, req); err == nil {
+			_, err = srv.NodeStageVolume(ctx, req)
+		}
+
+	case journal.OpPublish:
+		if !hasVolData(r.TargetPath) {
+			log.Infof("Rolling back publish of volume %s: kubelet doesn't know about %s anymore",
+				r.VolumeID, r.TargetPath)
+			_, err = srv.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   r.VolumeID,
+				TargetPath: r.TargetPath,
+			})
+			break
+		}
+
+		req := &csi.NodePublishVolumeRequest{}
+		if err = unmarshalRequest(r.Request, req); err == nil {
+			_, err = srv.NodePublishVolume(ctx, req)
+		}
+
+	case journal.OpUnstage:
+		req := &csi.NodeUnstageVolumeRequest{}
+		if err = unmarshalRequest(r.Request, req); err == nil {
+			_, err = srv.NodeUnstageVolume(ctx, req)
+		}
+
+	case journal.OpUnpublish:
+		req := &csi.NodeUnpublishVolumeRequest{}
+		if err = unmarshalRequest(r.Request, req); err == nil {
+			_, err = srv.NodeUnpublishVolume(ctx, req)
+		}
+
+	default:
+		err = fmt.Errorf("unknown operation %q", r.Op)
+	}
+
+	return err
+}
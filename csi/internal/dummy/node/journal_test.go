@@ -0,0 +1,534 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/crashpoint"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/journal"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountcache"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+// Crash-injection tests of journal replay. Each test case runs node operations
+// of a volume in a helper process (see TestJournalCrashHelper), which is killed
+// at a crash point. The journal and mounts it leaves behind are then replayed
+// by a new node server, like after a restart of the node plugin.
+
+const (
+	// Environment variables configuring TestJournalCrashHelper.
+	crashTestDirEnv       = "DUMMY_FUSE_CSI_CRASH_TEST_DIR"
+	crashTestEphemeralEnv = "DUMMY_FUSE_CSI_CRASH_TEST_EPHEMERAL"
+
+	crashTestVolumeID = "vol-1"
+	crashTestPodUID   = "6a1b0f5e-3c1d-4b8e-9f4e-2b9c7d0a5e11"
+)
+
+var (
+	journalCrashPoints = []string{
+		"stage:begin",
+		"stage:mounted",
+		"stage:cached",
+		"publish:begin",
+		"publish:mkdir",
+		"publish:staged",
+		"publish:mounted",
+		"publish:cached",
+		"unpublish:begin",
+		"unpublish:unmounted",
+		"unpublish:removed",
+		"unstage:begin",
+		"unstage:unmounted",
+	}
+
+	ephemeralJournalCrashPoints = []string{
+		"publish:begin",
+		"publish:mkdir",
+		"publish:mounted",
+		"publish:cached",
+		"unpublish:begin",
+		"unpublish:unmounted",
+		"unpublish:removed",
+	}
+)
+
+// crashTestEnv is a volume staged and published in a kubelet root
+// directory, along with state directories of the node server.
+// Each test case has its own environment. Also used by
+// TestConcurrentStagePublish.
+type crashTestEnv struct {
+	dir       string
+	ephemeral bool
+	fuse      *fakeFuseMounter
+
+	stagingPath string
+	targetPath  string
+}
+
+func newCrashTestEnv(dir string, ephemeral bool) *crashTestEnv {
+	kubeletRoot := path.Join(dir, "kubelet")
+
+	return &crashTestEnv{
+		dir:         dir,
+		ephemeral:   ephemeral,
+		fuse:        &fakeFuseMounter{},
+		stagingPath: path.Join(kubeletstate.CSIPluginDir(kubeletRoot), "pv", "pv-1", "globalmount"),
+		targetPath:  kubeletstate.TargetPath(kubeletRoot, crashTestPodUID, "pv-1"),
+	}
+}
+
+func (e *crashTestEnv) journalDir() string { return path.Join(e.dir, "journal") }
+
+// setup creates what kubelet creates before calling the node service.
+func (e *crashTestEnv) setup(t *testing.T) {
+	volData := &kubeletstate.VolData{
+		SpecVolID:           "pv-1",
+		VolumeHandle:        crashTestVolumeID,
+		DriverName:          "dummy-fuse-csi",
+		NodeName:            "node",
+		VolumeLifecycleMode: kubeletstate.PersistentVolumeLifecycleMode,
+	}
+
+	if e.ephemeral {
+		volData.VolumeLifecycleMode = kubeletstate.EphemeralVolumeLifecycleMode
+	} else {
+		if err := os.MkdirAll(e.stagingPath, 0750); err != nil {
+			t.Fatal(err)
+		}
+		writeVolData(t, path.Dir(e.stagingPath), volData)
+	}
+
+	if err := os.MkdirAll(path.Dir(e.targetPath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeVolData(t, path.Dir(e.targetPath), volData)
+}
+
+func writeVolData(t *testing.T, dir string, volData *kubeletstate.VolData) {
+	b, err := json.Marshal(volData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(path.Join(dir, kubeletstate.VolDataFileName), b, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *crashTestEnv) newServer(t *testing.T) *Server {
+	j, err := journal.New(e.journalDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := mountcache.New(path.Join(e.dir, "mountcache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := New(&Opts{
+		NodeID:      "node",
+		DriverName:  "dummy-fuse-csi",
+		KubeletRoot: path.Join(e.dir, "kubelet"),
+		MountCache:  mc,
+		Journal:     j,
+		BackingDir:  path.Join(e.dir, "backing"),
+	})
+	srv.fuseMounter = e.fuse
+
+	return srv
+}
+
+func (e *crashTestEnv) volumeCapability() *csi.VolumeCapability {
+	mode := csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	if e.ephemeral {
+		// Kubelet always requests ReadWriteOnce for inline volumes.
+		mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	}
+
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func (e *crashTestEnv) volumeContext() map[string]string {
+	volCtx := map[string]string{volumeattrs.KeyRestoreMount: "true"}
+	if e.ephemeral {
+		volCtx[ephemeralVolumeContextKey] = "true"
+	}
+
+	return volCtx
+}
+
+// run stages, publishes, unpublishes and unstages the volume.
+func (e *crashTestEnv) run(ctx context.Context, srv *Server) error {
+	if !e.ephemeral {
+		if _, err := srv.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          crashTestVolumeID,
+			StagingTargetPath: e.stagingPath,
+			VolumeCapability:  e.volumeCapability(),
+			VolumeContext:     e.volumeContext(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         crashTestVolumeID,
+		TargetPath:       e.targetPath,
+		VolumeCapability: e.volumeCapability(),
+		VolumeContext:    e.volumeContext(),
+	}
+	if !e.ephemeral {
+		req.StagingTargetPath = e.stagingPath
+	}
+
+	if _, err := srv.NodePublishVolume(ctx, req); err != nil {
+		return err
+	}
+
+	if _, err := srv.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   crashTestVolumeID,
+		TargetPath: e.targetPath,
+	}); err != nil {
+		return err
+	}
+
+	if !e.ephemeral {
+		if _, err := srv.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          crashTestVolumeID,
+			StagingTargetPath: e.stagingPath,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// crash runs the volume's node operations in TestJournalCrashHelper,
+// and expects the helper to be killed at crash point.
+func (e *crashTestEnv) crash(t *testing.T, point string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestJournalCrashHelper$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		crashTestDirEnv+"="+e.dir,
+		crashpoint.EnvName+"="+point,
+	)
+	if e.ephemeral {
+		cmd.Env = append(cmd.Env, crashTestEphemeralEnv+"=true")
+	}
+
+	out, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected the helper to be killed at %s, it exited with %v:\n%s", point, err, out)
+	}
+
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != unix.SIGKILL {
+		t.Fatalf("expected the helper to be killed at %s, it exited with %v:\n%s", point, err, out)
+	}
+}
+
+func (e *crashTestEnv) pending(t *testing.T) []*journal.Entry {
+	j, err := journal.New(e.journalDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := j.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+// readJournal returns contents of the journal's record files.
+func (e *crashTestEnv) readJournal(t *testing.T) map[string][]byte {
+	dirEntries, err := os.ReadDir(e.journalDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string][]byte)
+	for _, de := range dirEntries {
+		b, err := os.ReadFile(path.Join(e.journalDir(), de.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[de.Name()] = b
+	}
+
+	return records
+}
+
+func (e *crashTestEnv) writeJournal(t *testing.T, records map[string][]byte) {
+	for name, b := range records {
+		if err := os.WriteFile(path.Join(e.journalDir(), name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mounts returns mountpoints and file-system types of all mounts in the test directory.
+func (e *crashTestEnv) mounts(t *testing.T) []string {
+	mnts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(e.dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res []string
+	for _, m := range mnts {
+		res = append(res, m.Mountpoint+" "+m.FSType)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// teardown detaches all mounts in the test directory, including the corrupted
+// ones left behind by the helper, and waits for their FUSE sessions to end.
+func (e *crashTestEnv) teardown(t *testing.T) {
+	mnts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(e.dir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sort.Slice(mnts, func(i, j int) bool { return mnts[i].ID > mnts[j].ID })
+
+	for _, m := range mnts {
+		if err := unix.Unmount(m.Mountpoint, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+			t.Errorf("failed to unmount %s: %v", m.Mountpoint, err)
+		}
+	}
+
+	if err := e.fuse.wait(10 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+// checkMount checks that p has exactly one healthy dummy-fuse mount if mounted
+// is true, and that it's not mounted otherwise. Unmounted target paths must be removed.
+func (e *crashTestEnv) checkMount(t *testing.T, p string, mounted bool) {
+	t.Helper()
+
+	mnts, err := mountutils.GetStackedMounts(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !mounted {
+		if len(mnts) > 0 {
+			t.Errorf("expected %s to be unmounted, found %d mounts", p, len(mnts))
+		}
+
+		if p == e.targetPath && pathExists(p) {
+			t.Errorf("expected target path %s to be removed", p)
+		}
+
+		return
+	}
+
+	if len(mnts) != 1 {
+		t.Errorf("expected %s to be mounted once, found %d mounts", p, len(mnts))
+		return
+	}
+
+	if mnts[0].FSType != dummyFuseFSType {
+		t.Errorf("expected %s mount in %s, found %s", dummyFuseFSType, p, mnts[0].FSType)
+	}
+
+	if st, err := mountutils.GetState(p); err != nil || st != mountutils.StMounted {
+		t.Errorf("expected %s to be %s, got %s (%v)", p, mountutils.StMounted, st, err)
+	}
+}
+
+// checkMountCache checks that the mount cache has an entry for p iff cached is true.
+func (e *crashTestEnv) checkMountCache(t *testing.T, p string, cached bool) {
+	t.Helper()
+
+	mc, err := mountcache.New(path.Join(e.dir, "mountcache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	if p == e.stagingPath {
+		staged, err := mc.ListStaged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range staged {
+			found = found || staged[i].StagingTargetPath == p
+		}
+	} else {
+		published, err := mc.ListPublished()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range published {
+			found = found || published[i].TargetPath == p
+		}
+	}
+
+	if found != cached {
+		t.Errorf("expected mount cache entry of %s to exist: %t, got %t", p, cached, found)
+	}
+}
+
+// checkReplayed checks that there's nothing left in the journal, and that
+// the interrupted operation op was rolled forward or back.
+func (e *crashTestEnv) checkReplayed(t *testing.T, op journal.Op, rollForward bool) {
+	t.Helper()
+
+	for _, pe := range e.pending(t) {
+		t.Errorf("unexpected %s of volume %s left in the journal after replay (seq %d)", pe.Op, pe.VolumeID, pe.Seq)
+	}
+
+	switch op {
+	case journal.OpStage:
+		e.checkMount(t, e.stagingPath, rollForward)
+		e.checkMountCache(t, e.stagingPath, rollForward)
+	case journal.OpPublish:
+		if rollForward && !e.ephemeral {
+			e.checkMount(t, e.stagingPath, true)
+		}
+		e.checkMount(t, e.targetPath, rollForward)
+		e.checkMountCache(t, e.targetPath, rollForward)
+	case journal.OpUnpublish:
+		e.checkMount(t, e.targetPath, false)
+		e.checkMountCache(t, e.targetPath, false)
+	case journal.OpUnstage:
+		e.checkMount(t, e.stagingPath, false)
+		e.checkMountCache(t, e.stagingPath, false)
+	}
+}
+
+// TestJournalCrashHelper runs node operations of the volume configured
+// by TestJournalReplayAfterCrash, and is expected to be killed at a crash point.
+func TestJournalCrashHelper(t *testing.T) {
+	dir := os.Getenv(crashTestDirEnv)
+	if dir == "" {
+		t.Skip("run by TestJournalReplayAfterCrash")
+	}
+
+	e := newCrashTestEnv(dir, os.Getenv(crashTestEphemeralEnv) != "")
+	if err := e.run(context.Background(), e.newServer(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reaching this point means the crash point was never hit,
+	// and the helper exits normally.
+}
+
+func TestJournalReplayAfterCrash(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE is not available")
+	}
+
+	run := func(name string, ephemeral bool, points []string) {
+		for _, point := range points {
+			op := journal.Op(strings.SplitN(point, ":", 2)[0])
+
+			// Unstage and unpublish are always rolled forward.
+			rollBack := []bool{false}
+			if op == journal.OpStage || op == journal.OpPublish {
+				rollBack = append(rollBack, true)
+			}
+
+			for _, rb := range rollBack {
+				direction := "roll-forward"
+				if rb {
+					direction = "roll-back"
+				}
+
+				point, rb := point, rb
+				t.Run(path.Join(name, point, direction), func(t *testing.T) {
+					testReplayAfterCrash(t, ephemeral, point, op, rb)
+				})
+			}
+		}
+	}
+
+	run("persistent", false, journalCrashPoints)
+	run("ephemeral", true, ephemeralJournalCrashPoints)
+}
+
+func testReplayAfterCrash(t *testing.T, ephemeral bool, point string, op journal.Op, rollBack bool) {
+	e := newCrashTestEnv(t.TempDir(), ephemeral)
+	t.Cleanup(func() { e.teardown(t) })
+
+	e.setup(t)
+	e.crash(t, point)
+
+	// The interrupted operation must be the only one left in the journal.
+	entries := e.pending(t)
+	if len(entries) != 1 || entries[0].Op != op {
+		var ops []journal.Op
+		for _, pe := range entries {
+			ops = append(ops, pe.Op)
+		}
+		t.Fatalf("expected %s to be left in the journal, found %v", op, ops)
+	}
+
+	if rollBack {
+		// Kubelet gave up on the volume while the node plugin was down.
+		mountpoint := e.targetPath
+		if op == journal.OpStage {
+			mountpoint = e.stagingPath
+		}
+
+		if err := os.Remove(path.Join(path.Dir(mountpoint), kubeletstate.VolDataFileName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := e.readJournal(t)
+
+	e.newServer(t).ReplayJournal()
+	e.checkReplayed(t, op, !rollBack)
+
+	mnts := e.mounts(t)
+
+	// Replay the same records again, as if the node plugin was killed
+	// after replaying them, but before committing them. This must not
+	// change anything.
+	e.writeJournal(t, records)
+
+	e.newServer(t).ReplayJournal()
+	e.checkReplayed(t, op, !rollBack)
+
+	if mnts2 := e.mounts(t); !reflect.DeepEqual(mnts, mnts2) {
+		t.Errorf("replaying the journal again changed mounts from %v to %v", mnts, mnts2)
+	}
+}
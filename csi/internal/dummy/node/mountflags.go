@@ -0,0 +1,262 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mount flags are taken from VolumeCapability.Mount.MountFlags. They are split
+// into two groups:
+//
+//   * FUSE options are applied when mounting dummy-fuse, i.e. on stage
+//     (or on publish of ephemeral volumes). They are ignored on publish,
+//     as bind mounts cannot change them.
+//   * VFS flags are applied when publishing the volume, as a bind remount
+//     of the target path (or directly on the FUSE mount of ephemeral volumes).
+
+type (
+	// vfsFlag is a generic per-mountpoint flag that may be changed with a bind remount.
+	vfsFlag struct {
+		// msFlag is the corresponding MS_* mount(2) flag.
+		msFlag uintptr
+		// set is true if the flag sets msFlag, false if it clears it.
+		set bool
+		// mountAttr is the corresponding MOUNT_ATTR_* mount_setattr(2) attribute.
+		mountAttr uint64
+	}
+
+	// mountOptions holds parsed and validated mount flags.
+	mountOptions struct {
+		// fuse options passed to dummy-fuse.
+		fuse []string
+		// vfs flags applied to the mountpoint.
+		vfs []string
+	}
+)
+
+var (
+	vfsFlags = map[string]vfsFlag{
+		"ro":         {unix.MS_RDONLY, true, unix.MOUNT_ATTR_RDONLY},
+		"rw":         {unix.MS_RDONLY, false, unix.MOUNT_ATTR_RDONLY},
+		"nosuid":     {unix.MS_NOSUID, true, unix.MOUNT_ATTR_NOSUID},
+		"nodev":      {unix.MS_NODEV, true, unix.MOUNT_ATTR_NODEV},
+		"noexec":     {unix.MS_NOEXEC, true, unix.MOUNT_ATTR_NOEXEC},
+		"exec":       {unix.MS_NOEXEC, false, unix.MOUNT_ATTR_NOEXEC},
+		"noatime":    {unix.MS_NOATIME, true, unix.MOUNT_ATTR_NOATIME},
+		"atime":      {unix.MS_NOATIME, false, unix.MOUNT_ATTR_NOATIME},
+		"nodiratime": {unix.MS_NODIRATIME, true, unix.MOUNT_ATTR_NODIRATIME},
+		"diratime":   {unix.MS_NODIRATIME, false, unix.MOUNT_ATTR_NODIRATIME},
+	}
+
+	// VFS flags that are rejected, as volumes are always mounted nosuid,nodev.
+	deniedVfsFlags = map[string]bool{
+		"suid": true,
+		"dev":  true,
+	}
+
+	// FUSE options understood both by libfuse and by the kernel,
+	// so that they can be used with any fuseMounter.
+	fuseOptions = map[string]struct {
+		// hasValue is true for key=value options.
+		hasValue bool
+	}{
+		"allow_other":         {false},
+		"default_permissions": {false},
+		"max_read":            {true},
+	}
+)
+
+func supportedMountFlags() []string {
+	var flags []string
+	for f := range fuseOptions {
+		flags = append(flags, f)
+	}
+	for f := range vfsFlags {
+		flags = append(flags, f)
+	}
+
+	sort.Strings(flags)
+
+	return flags
+}
+
+// parseMountFlags parses and validates mount flags. Each flag may be a comma-separated
+// list of flags. If readOnly is set, "ro" flag is added to the VFS flags.
+func parseMountFlags(flags []string, readOnly bool) (*mountOptions, error) {
+	var (
+		opts = &mountOptions{}
+		seen = make(map[string]string)
+		// Flags seen so far, keyed by the MS_* flag they affect.
+		seenVfs = make(map[uintptr]string)
+	)
+
+	if readOnly {
+		opts.vfs = append(opts.vfs, "ro")
+		seenVfs[unix.MS_RDONLY] = "ro"
+	}
+
+	for _, flagList := range flags {
+		for _, flag := range strings.Split(flagList, ",") {
+			flag = strings.TrimSpace(flag)
+			if flag == "" {
+				continue
+			}
+
+			key, value, hasValue := strings.Cut(flag, "=")
+
+			if deniedVfsFlags[key] {
+				return nil, fmt.Errorf("mount flag %s is not allowed, volumes are always mounted with nosuid,nodev", key)
+			}
+
+			if vf, ok := vfsFlags[key]; ok {
+				if hasValue {
+					return nil, fmt.Errorf("mount flag %s does not take a value", key)
+				}
+
+				if prev, ok := seenVfs[vf.msFlag]; ok {
+					if prev != key {
+						if readOnly && prev == "ro" {
+							return nil, fmt.Errorf("mount flag %s conflicts with readonly volume", key)
+						}
+						return nil, fmt.Errorf("mount flag %s conflicts with %s", key, prev)
+					}
+					// Duplicate flag.
+					continue
+				}
+
+				seenVfs[vf.msFlag] = key
+				opts.vfs = append(opts.vfs, key)
+				continue
+			}
+
+			fo, ok := fuseOptions[key]
+			if !ok {
+				return nil, fmt.Errorf("unsupported mount flag %s, supported flags are %s",
+					key, strings.Join(supportedMountFlags(), ", "))
+			}
+
+			if fo.hasValue != hasValue {
+				if fo.hasValue {
+					return nil, fmt.Errorf("mount flag %s requires a value", key)
+				}
+				return nil, fmt.Errorf("mount flag %s does not take a value", key)
+			}
+
+			if key == "max_read" {
+				if n, err := strconv.ParseUint(value, 10, 32); err != nil || n == 0 {
+					return nil, fmt.Errorf("invalid value %q for mount flag %s: must be a positive integer", value, key)
+				}
+			}
+
+			if prevValue, ok := seen[key]; ok {
+				if prevValue != value {
+					return nil, fmt.Errorf("mount flag %s specified multiple times with different values", key)
+				}
+				continue
+			}
+
+			seen[key] = value
+			opts.fuse = append(opts.fuse, flag)
+		}
+	}
+
+	return opts, nil
+}
+
+// fuseMountFlags converts FUSE mount options into mount(2) flags and
+// the FUSE-specific part of mount(2) data.
+func fuseMountFlags(opts []string) (uintptr, []string) {
+	var (
+		msFlags uintptr = unix.MS_NOSUID | unix.MS_NODEV
+		data    []string
+	)
+
+	for _, opt := range opts {
+		if isDummyFuseOnlyOption(opt) {
+			continue
+		}
+
+		if vf, ok := vfsFlags[opt]; ok {
+			if vf.set {
+				msFlags |= vf.msFlag
+			} else {
+				msFlags &^= vf.msFlag
+			}
+			continue
+		}
+
+		data = append(data, opt)
+	}
+
+	return msFlags, data
+}
+
+// vfsMountAttr returns mount_setattr(2) attributes that apply VFS flags.
+func vfsMountAttr(flags []string) *unix.MountAttr {
+	attr := &unix.MountAttr{}
+
+	for _, f := range flags {
+		vf, ok := vfsFlags[f]
+		if !ok {
+			continue
+		}
+
+		if vf.mountAttr == unix.MOUNT_ATTR_NOATIME {
+			// Access time attributes are an enum, not independent bits.
+			// Clearing noatime means the default relatime.
+			attr.Attr_clr |= unix.MOUNT_ATTR__ATIME
+			if vf.set {
+				attr.Attr_set |= unix.MOUNT_ATTR_NOATIME
+			}
+			continue
+		}
+
+		if vf.set {
+			attr.Attr_set |= vf.mountAttr
+		} else {
+			attr.Attr_clr |= vf.mountAttr
+		}
+	}
+
+	return attr
+}
+
+// applyVfsFlags returns msFlags with VFS flags applied.
+func applyVfsFlags(msFlags uintptr, flags []string) uintptr {
+	for _, f := range flags {
+		vf, ok := vfsFlags[f]
+		if !ok {
+			continue
+		}
+
+		if vf.set {
+			msFlags |= vf.msFlag
+		} else {
+			msFlags &^= vf.msFlag
+		}
+	}
+
+	return msFlags
+}
+
+// dummyFuseArgs returns dummy-fuse command line arguments for mounting into mountpoint.
+func dummyFuseArgs(mountpoint string, opts []string) []string {
+	var args []string
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+
+	return append(args, mountpoint)
+}
+
+// all returns both FUSE options and VFS flags, for mounting dummy-fuse
+// directly into the target path.
+func (o *mountOptions) all() []string {
+	opts := make([]string, 0, len(o.fuse)+len(o.vfs))
+	opts = append(opts, o.fuse...)
+	return append(opts, o.vfs...)
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMountFlags(t *testing.T) {
+	tests := []struct {
+		flags    []string
+		readOnly bool
+		fuse     []string
+		vfs      []string
+		invalid  bool
+	}{
+		{flags: []string{"allow_other,max_read=4096", "noexec"}, fuse: []string{"allow_other", "max_read=4096"}, vfs: []string{"noexec"}},
+		{flags: []string{"nosuid", "nodev,noatime"}, vfs: []string{"nosuid", "nodev", "noatime"}},
+		{flags: []string{"noexec,noexec"}, vfs: []string{"noexec"}},
+		{flags: []string{"exec"}, readOnly: true, vfs: []string{"ro", "exec"}},
+		{flags: []string{"rw"}, readOnly: true, invalid: true},
+		{flags: []string{"exec,noexec"}, invalid: true},
+		{flags: []string{"max_read=0"}, invalid: true},
+		{flags: []string{"sync"}, invalid: true},
+
+		// Volumes are always mounted nosuid,nodev.
+		{flags: []string{"suid"}, invalid: true},
+		{flags: []string{"dev"}, invalid: true},
+		{flags: []string{"nosuid,dev"}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		opts, err := parseMountFlags(tt.flags, tt.readOnly)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseMountFlags(%q, %t): expected an error, got %+v", tt.flags, tt.readOnly, opts)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseMountFlags(%q, %t) failed: %v", tt.flags, tt.readOnly, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(opts.fuse, tt.fuse) || !reflect.DeepEqual(opts.vfs, tt.vfs) {
+			t.Errorf("parseMountFlags(%q, %t): expected FUSE options %q and VFS flags %q, got %q and %q",
+				tt.flags, tt.readOnly, tt.fuse, tt.vfs, opts.fuse, opts.vfs)
+		}
+	}
+}
+
+func TestPublishRejectsSuidDev(t *testing.T) {
+	srv := &Server{inFlight: newInFlight()}
+
+	for _, flag := range []string{"suid", "dev"} {
+		_, err := srv.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:   "vol-1",
+			TargetPath: "/target/vol-1",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{flag}},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+			VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true"},
+		})
+
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected InvalidArgument for mount flag %s, got %v", flag, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountns"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+// injectRestoredMount replaces stale mounts of staleMnt device in mount
+// namespaces of other processes (i.e. consumer Pods) with fresh bind mounts
+// of sourcePath. It's a no-op if sourcePath wasn't actually remounted.
+//
+// Returns a report of the results per mount namespace, which is also logged.
+func (srv *Server) injectRestoredMount(volumeID, sourcePath string, staleMnt *mountinfo.Info) []mountns.NamespaceReport {
+	freshMnt, err := mountutils.GetMountInfo(sourcePath)
+	if err != nil {
+		log.Errorf("Mount injection: failed to read mount table entry of %s: %v", sourcePath, err)
+		return nil
+	}
+
+	if freshMnt == nil || (freshMnt.Major == staleMnt.Major && freshMnt.Minor == staleMnt.Minor) {
+		// Nothing was remounted.
+		return nil
+	}
+
+	// Staging and target paths in our own mount namespace
+	// are restored by the regular reconcile routines.
+	skipPaths := make(map[string]struct{})
+	staged, published := srv.volumes.snapshot()
+	for i := range staged {
+		skipPaths[staged[i].stagingPath] = struct{}{}
+	}
+	for i := range published {
+		skipPaths[published[i].targetPath] = struct{}{}
+	}
+
+	staleMounts, err := mountns.FindStaleMounts(staleMnt.Major, staleMnt.Minor, skipPaths)
+	if err != nil {
+		log.Errorf("Mount injection: failed to find stale mounts of volume %s: %v", volumeID, err)
+		return nil
+	}
+
+	if len(staleMounts) == 0 {
+		log.Infof("Mount injection: no stale mounts of volume %s found", volumeID)
+		return nil
+	}
+
+	reports := mountns.ReportByNamespace(mountns.Inject(sourcePath, staleMounts))
+
+	var fixedNS int
+	for i := range reports {
+		if reports[i].OK() {
+			fixedNS++
+			log.Infof("Mount injection: volume %s: %s", volumeID, &reports[i])
+		} else {
+			log.Errorf("Mount injection: volume %s: %s", volumeID, &reports[i])
+		}
+	}
+
+	log.Infof("Mount injection: volume %s: fixed %d of %d mount namespaces",
+		volumeID, fixedNS, len(reports))
+
+	return reports
+}
@@ -1,20 +1,107 @@
 package node
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	goexec "os/exec"
+	"strings"
 
 	"github.com/gman0/dummy-fuse-csi/csi/internal/exec"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
 	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+
+	"golang.org/x/sys/unix"
 )
 
-func bindMount(from, to string) error {
-	_, err := exec.CombinedOutput(goexec.Command("mount", "--bind", from, to))
-	return err
+// File-system type of dummy-fuse mounts, including bind mounts of them.
+const dummyFuseFSType = "fuse.dummy-fuse"
+
+func bindMount(ctx context.Context, from, to string, flags []string) error {
+	var err error
+	if mountutils.CurrentBackend() == mountutils.BackendExec {
+		_, err = exec.CombinedOutputContext(ctx, goexec.Command("mount", "--bind", from, to))
+	} else {
+		err = mountutils.BindMount(ctx, from, to, false)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return remountBind(ctx, to, flags)
+}
+
+// remountBind applies flags to the bind mount in mountpoint. If that fails,
+// the bind mount is unmounted.
+func remountBind(ctx context.Context, to string, flags []string) error {
+	if len(flags) == 0 {
+		return nil
+	}
+
+	var err error
+	if mountutils.CurrentBackend() == mountutils.BackendExec {
+		// Per-mountpoint flags of a bind mount can only be changed by remounting it.
+		_, err = exec.CombinedOutputContext(ctx, goexec.Command(
+			"mount", "-o", "remount,bind,"+strings.Join(flags, ","), to))
+	} else {
+		err = remountBindNative(ctx, to, flags)
+	}
+
+	if err != nil {
+		// Don't leave behind a bind mount with wrong flags (e.g. without ro).
+		if unmountErr := mountutils.Unmount(ctx, to, mountutils.UnmountRecursive); unmountErr != nil {
+			log.Errorf("Failed to unmount %s after failing to remount it: %v", to, unmountErr)
+		}
+
+		return fmt.Errorf("failed to apply mount flags %v: %w", flags, err)
+	}
+
+	return nil
+}
+
+// remountBindNative applies flags with mount_setattr. On kernels that don't
+// support it, it falls back to a bind remount, which replaces all per-mountpoint
+// flags, so the current ones are read from the mount table first.
+func remountBindNative(ctx context.Context, to string, flags []string) error {
+	err := mountutils.SetMountAttr(ctx, to, vfsMountAttr(flags), false)
+	if !errors.Is(err, unix.ENOSYS) {
+		return err
+	}
+
+	mnt, err := mountutils.GetMountInfo(to)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	if mnt == nil {
+		return fmt.Errorf("%s is not mounted", to)
+	}
+
+	return mountutils.RemountBind(ctx, to, applyVfsFlags(mountutils.MountFlags(mnt), flags))
+}
+
+func slaveRecursiveBind(ctx context.Context, from, to string, flags []string) error {
+	var err error
+	if mountutils.CurrentBackend() == mountutils.BackendExec {
+		err = slaveRecursiveBindExec(ctx, from, to)
+	} else {
+		// Same as the exec variant below, see there for details.
+		if err = mountutils.BindMount(ctx, from, to, true); err == nil {
+			err = mountutils.MakeSlave(ctx, to)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return remountBind(ctx, to, flags)
 }
 
-func slaveRecursiveBind(from, to string) error {
-	_, err := exec.CombinedOutput(goexec.Command(
+func slaveRecursiveBindExec(ctx context.Context, from, to string) error {
+	_, err := exec.CombinedOutputContext(ctx, goexec.Command(
 		"mount",
 		from,
 		to,
@@ -37,14 +124,50 @@ func slaveRecursiveBind(from, to string) error {
 	return err
 }
 
-func recursiveUnmount(mountpoint string) error {
+func recursiveUnmount(ctx context.Context, mountpoint string) error {
 	// We need recursive unmount because there are live mounts inside the bindmount.
 	// Unmounting only the upper autofs mount would result in EBUSY.
-	return mountutils.Unmount(mountpoint, "--recursive")
+	return mountutils.UnmountWithStrategies(ctx, mountpoint, mountutils.BindUnmountStrategies, mountutils.UnmountRecursive)
+}
+
+// unmountBind unmounts a bind mount in mountpoint, escalating to lazy unmount if needed.
+func unmountBind(ctx context.Context, mountpoint string) error {
+	return mountutils.UnmountWithStrategies(ctx, mountpoint, mountutils.BindUnmountStrategies, 0)
 }
 
-func mountDummyFuse(mountpoint string) error {
-	return exec.Run(goexec.Command("dummy-fuse", mountpoint))
+// mountFuseSession mounts FUSE session fd (an open /dev/fuse file) into mountpoint.
+func mountFuseSession(mountpoint string, fd int, opts []string) error {
+	msFlags, fuseData := fuseMountFlags(opts)
+	data := append([]string{
+		fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fd),
+	}, fuseData...)
+
+	return unix.Mount(
+		"dummy-fuse",
+		mountpoint,
+		dummyFuseFSType,
+		msFlags,
+		strings.Join(data, ","),
+	)
+}
+
+// mountDummyFuseSession runs dummy-fuse serving an already mounted FUSE session.
+// Only dummy-fuse specific options are passed from opts, as the mount options
+// were already applied when mounting the session.
+func mountDummyFuseSession(ctx context.Context, session *os.File, opts []string) error {
+	var dummyFuseOpts []string
+	for _, opt := range opts {
+		if isDummyFuseOnlyOption(opt) {
+			dummyFuseOpts = append(dummyFuseOpts, opt)
+		}
+	}
+
+	// libfuse treats /dev/fd/N mountpoint as an already opened
+	// and mounted /dev/fuse file descriptor. ExtraFiles start at fd 3.
+	cmd := goexec.Command("dummy-fuse", dummyFuseArgs("/dev/fd/3", dummyFuseOpts)...)
+	cmd.ExtraFiles = []*os.File{session}
+
+	return exec.RunContext(ctx, cmd)
 }
 
 // Mount function signature used by reconcileMount().
@@ -53,7 +176,7 @@ type mountFunc func(mountpoint string) error
 // Reconciles the mountpoint. If it's corrupted (e.g. ENOTCONN -- its mount provider exited)
 // it unmounts it first. If it's unmounted, it calls the mountF function to restore the volume.
 // If it is already mounted, it does nothing.
-func reconcileMount(mountpoint string, mountF mountFunc) error {
+func reconcileMount(ctx context.Context, mountpoint string, mountF mountFunc) error {
 	mntState, err := mountutils.GetState(mountpoint)
 	if err != nil {
 		return fmt.Errorf("failed to probe mountpoint %s: %v", mountpoint, err)
@@ -62,19 +185,51 @@ func reconcileMount(mountpoint string, mountF mountFunc) error {
 	switch mntState {
 	case mountutils.StCorrupted:
 		// Detected mount corruption. Try to remount.
-		if err := mountutils.Unmount(mountpoint); err != nil {
-			return fmt.Errorf("failed to unmount %s during mount recovery: %v", mountpoint, err)
+		if err := unmountCorruptedMount(ctx, mountpoint); err != nil {
+			return err
 		}
 		fallthrough
 	case mountutils.StNotMounted:
 		if err := mountF(mountpoint); err != nil {
-			return fmt.Errorf("failed mount into %s: %v", mountpoint, err)
+			return fmt.Errorf("failed mount into %s: %w", mountpoint, err)
 		}
 		fallthrough
 	case mountutils.StMounted:
 		return nil
+	case mountutils.StHung:
+		// The mount provider is alive, but doesn't respond. Remounting
+		// would hide the problem rather than fix it.
+		return fmt.Errorf("mountpoint %s is not responding", mountpoint)
 	default:
 		return fmt.Errorf("unexpected mountpoint state in %s: expected %s or %s, got %s",
 			mountpoint, mountutils.StNotMounted, mountutils.StMounted, mntState)
 	}
 }
+
+func unmountCorruptedMount(ctx context.Context, mountpoint string) error {
+	if err := mountutils.UnmountEscalating(ctx, mountpoint, 0); err != nil {
+		return fmt.Errorf("failed to unmount %s during mount recovery: %w", mountpoint, err)
+	}
+
+	return nil
+}
+
+// unmountCorrupted unmounts mountpoint if its mount is corrupted, the same way
+// reconcileMount does, but without mounting anything in its place. Mountpoints
+// that don't exist are left alone.
+func unmountCorrupted(ctx context.Context, mountpoint string) error {
+	mntState, err := mountutils.GetState(mountpoint)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to probe mountpoint %s: %v", mountpoint, err)
+	}
+
+	if mntState != mountutils.StCorrupted {
+		return nil
+	}
+
+	return unmountCorruptedMount(ctx, mountpoint)
+}
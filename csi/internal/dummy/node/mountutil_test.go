@@ -0,0 +1,81 @@
+package node
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+
+	"golang.org/x/sys/unix"
+)
+
+// benchmarkStagePublish measures the mount operations that stage/publish and
+// unpublish/unstage perform with the given backend: bind-mounting the staging
+// path into the target path and applying mount flags to it, unmounting the target
+// path and unmounting the staging path. A tmpfs stands in for the dummy-fuse
+// staging mount, as starting dummy-fuse costs the same with both backends.
+func benchmarkStagePublish(b *testing.B, backend mountutils.Backend) {
+	if os.Geteuid() != 0 {
+		b.Skip("mounting requires root")
+	}
+
+	prevBackend := mountutils.CurrentBackend()
+	mountutils.SetBackend(backend)
+	defer mountutils.SetBackend(prevBackend)
+
+	var (
+		ctx         = context.Background()
+		dir         = b.TempDir()
+		stagingPath = path.Join(dir, "staging")
+		targetPath  = path.Join(dir, "target")
+	)
+
+	for _, p := range []string{stagingPath, targetPath} {
+		if err := os.Mkdir(p, 0700); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, mode := range []volumeattrs.PublishMode{volumeattrs.PublishModeBind, volumeattrs.PublishModeRbindSlave} {
+		b.Run(string(mode), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := unix.Mount("tmpfs", stagingPath, "tmpfs", 0, ""); err != nil {
+					b.Fatalf("failed to mount staging path: %v", err)
+				}
+				b.StartTimer()
+
+				if err := reconcilePublishPath(ctx, stagingPath, targetPath, mode, []string{"ro", "noexec"}); err != nil {
+					b.Fatalf("publish failed: %v", err)
+				}
+
+				if err := unpublishTarget(ctx, targetPath, mode); err != nil {
+					b.Fatalf("unpublish failed: %v", err)
+				}
+
+				if err := mountutils.Unmount(ctx, stagingPath, 0); err != nil {
+					b.Fatalf("unstage failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func unpublishTarget(ctx context.Context, targetPath string, mode volumeattrs.PublishMode) error {
+	if mode == volumeattrs.PublishModeRbindSlave {
+		return recursiveUnmount(ctx, targetPath)
+	}
+
+	return unmountBind(ctx, targetPath)
+}
+
+func BenchmarkStagePublishNative(b *testing.B) {
+	benchmarkStagePublish(b, mountutils.BackendNative)
+}
+
+func BenchmarkStagePublishExec(b *testing.B) {
+	benchmarkStagePublish(b, mountutils.BackendExec)
+}
@@ -0,0 +1,76 @@
+package node
+
+import (
+	"context"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+// Size of the mount event buffer. Events that don't fit are dropped,
+// the periodic health checks will catch up with them.
+const mountEventsBufSize = 64
+
+// StartMountWatcher starts background goroutines that watch the mount table,
+// and run health checks of tracked volumes as soon as their mounts change.
+// It is a no-op if mount watching was not enabled in Opts.
+func (srv *Server) StartMountWatcher() {
+	if !srv.watchMounts {
+		return
+	}
+
+	w := mountutils.NewWatcher(srv.volumes.tracks)
+	events, _ := w.Subscribe(mountEventsBufSize)
+
+	go func() {
+		log.Infof("Starting mount watcher")
+
+		if err := w.Run(context.Background()); err != nil {
+			log.Errorf("Mount watcher failed, falling back to periodic health checks only: %v", err)
+		}
+	}()
+
+	go func() {
+		for e := range events {
+			srv.handleMountEvent(&e)
+		}
+	}()
+}
+
+func (srv *Server) handleMountEvent(e *mountutils.Event) {
+	log.Debugf("Mount watcher: %s", e)
+
+	if e.Type == mountutils.EventMounted {
+		// Mounts of tracked paths are done by us.
+		return
+	}
+
+	m := srv.healthMonitor
+	staged, published := srv.volumes.snapshot()
+
+	// The mountpoint was unmounted (or its flags changed) while no node RPC
+	// was running for it, otherwise tryCheck would skip it. Such volume is
+	// unmounted behind our back, and needs to be remounted like a corrupted one.
+
+	for i := range staged {
+		v := &staged[i]
+		if v.stagingPath != e.Mountpoint || !v.cfg.HealthCheck {
+			continue
+		}
+
+		srv.tryCheck(m, v.volumeID, v.stagingPath, true, func() error {
+			return srv.reconcileStagingPath(context.Background(), v.volumeID, v.stagingPath, v.mountOptions)
+		})
+	}
+
+	for i := range published {
+		v := &published[i]
+		if v.targetPath != e.Mountpoint || !v.cfg.HealthCheck {
+			continue
+		}
+
+		srv.tryCheck(m, v.volumeID, v.targetPath, true, func() error {
+			return srv.reconcilePublishedVolume(context.Background(), v)
+		})
+	}
+}
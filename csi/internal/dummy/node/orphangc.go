@@ -0,0 +1,406 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/kubeletstate"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+// Orphan GC looks for leftovers of volumes that kubelet doesn't know about
+// anymore, typically after the node plugin or kubelet crashed in the middle
+// of a node RPC:
+//
+//   * dummy-fuse mounts and their bind mounts under the kubelet root, whose
+//     vol_data.json or Pod directory is gone,
+//   * empty target directories without vol_data.json, that we know were
+//     created for our volumes: target paths of entries in the mount cache,
+//     or of operations left in the journal. Target directories of other CSI
+//     drivers look exactly the same, and must be left alone.
+//
+// Paths of tracked volumes, and paths with a node RPC in progress are never
+// considered orphaned.
+
+type (
+	orphanGC struct {
+		interval time.Duration
+		dryRun   bool
+	}
+
+	orphanKind int
+
+	orphan struct {
+		path   string
+		kind   orphanKind
+		reason string
+
+		// volumeID is set for orphanTargetDir.
+		volumeID string
+	}
+)
+
+const (
+	orphanStagingMount orphanKind = iota
+	orphanTargetMount
+	orphanTargetDir
+)
+
+// Empty target directories are left alone for this long after they were
+// last modified, so that we don't race with kubelet setting up a new volume.
+const orphanTargetDirGracePeriod = 10 * time.Minute
+
+func (k orphanKind) String() string {
+	switch k {
+	case orphanStagingMount:
+		return "staging mount"
+	case orphanTargetMount:
+		return "target mount"
+	case orphanTargetDir:
+		return "empty target directory"
+	default:
+		return fmt.Sprintf("orphanKind(%d)", int(k))
+	}
+}
+
+func (o *orphan) String() string {
+	return fmt.Sprintf("%s %s (%s)", o.kind, o.path, o.reason)
+}
+
+// StartOrphanGC starts a background goroutine that collects orphaned mounts
+// and target directories right away, and then every Opts.OrphanGCInterval.
+// It is a no-op if orphan GC was not enabled in Opts.
+func (srv *Server) StartOrphanGC() {
+	gc := srv.orphanGC
+	if gc == nil {
+		return
+	}
+
+	go func() {
+		log.Infof("Starting orphan GC in %s (interval: %s, dry run: %t)", srv.kubeletRoot, gc.interval, gc.dryRun)
+
+		srv.collectOrphans(gc)
+
+		if gc.interval <= 0 {
+			return
+		}
+
+		t := time.NewTicker(gc.interval)
+		defer t.Stop()
+
+		for range t.C {
+			srv.collectOrphans(gc)
+		}
+	}()
+}
+
+func (srv *Server) collectOrphans(gc *orphanGC) {
+	orphans, err := srv.findOrphans(srv.kubeletRoot)
+	if err != nil {
+		log.Errorf("Orphan GC: failed to look for orphans: %v", err)
+		return
+	}
+
+	if len(orphans) == 0 {
+		log.Debugf("Orphan GC: no orphans found")
+		return
+	}
+
+	var collected int
+	for i := range orphans {
+		o := &orphans[i]
+
+		if gc.dryRun {
+			log.Infof("Orphan GC: found %s, not removing it in dry run", o)
+			continue
+		}
+
+		if err := srv.collectOrphan(context.Background(), srv.kubeletRoot, o); err != nil {
+			log.Errorf("Orphan GC: failed to remove %s: %v", o, err)
+			continue
+		}
+
+		log.Infof("Orphan GC: removed %s", o)
+		collected++
+	}
+
+	log.Infof("Orphan GC: found %d orphans, removed %d", len(orphans), collected)
+}
+
+// findOrphans returns orphaned mounts and target directories under kubeletRoot.
+// Target mounts come before staging mounts, so that bind mounts are removed
+// before their source.
+func (srv *Server) findOrphans(kubeletRoot string) ([]orphan, error) {
+	mnts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(kubeletRoot))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	var orphans []orphan
+	mounted := make(map[string]struct{}, len(mnts))
+
+	for _, m := range mnts {
+		if _, ok := mounted[m.Mountpoint]; ok {
+			// Stacked mounts are handled by their mountpoint.
+			continue
+		}
+		mounted[m.Mountpoint] = struct{}{}
+
+		if m.FSType != dummyFuseFSType {
+			continue
+		}
+
+		if o := srv.checkOrphanMount(kubeletRoot, m.Mountpoint); o != nil {
+			orphans = append(orphans, *o)
+		}
+	}
+
+	dirs, err := srv.findOrphanTargetDirs(kubeletRoot, mounted)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, dirs...)
+
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return orphans[i].kind > orphans[j].kind
+	})
+
+	return orphans, nil
+}
+
+// checkOrphanMount returns non-nil orphan if dummy-fuse mount in mountpoint
+// is orphaned. Mountpoints outside of kubelet's staging and target paths
+// are never orphaned.
+func (srv *Server) checkOrphanMount(kubeletRoot, mountpoint string) *orphan {
+	if srv.volumes.tracks(mountpoint) {
+		return nil
+	}
+
+	if podUID, _, ok := kubeletstate.ParseTargetPath(kubeletRoot, mountpoint); ok {
+		if !pathExists(kubeletstate.PodDir(kubeletRoot, podUID)) {
+			return &orphan{path: mountpoint, kind: orphanTargetMount, reason: "Pod directory is gone"}
+		}
+
+		if !hasVolData(mountpoint) {
+			return &orphan{path: mountpoint, kind: orphanTargetMount, reason: "vol_data.json is missing"}
+		}
+
+		return nil
+	}
+
+	if kubeletstate.IsStagingPath(kubeletRoot, mountpoint) && !hasVolData(mountpoint) {
+		return &orphan{path: mountpoint, kind: orphanStagingMount, reason: "vol_data.json is missing"}
+	}
+
+	return nil
+}
+
+// findOrphanTargetDirs returns empty target directories of our volumes
+// without vol_data.json that are not mounted.
+func (srv *Server) findOrphanTargetDirs(kubeletRoot string, mounted map[string]struct{}) ([]orphan, error) {
+	owned, err := srv.ownedTargetPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	targetPaths := make([]string, 0, len(owned))
+	for p := range owned {
+		targetPaths = append(targetPaths, p)
+	}
+	sort.Strings(targetPaths)
+
+	var orphans []orphan
+	for _, p := range targetPaths {
+		if _, _, ok := kubeletstate.ParseTargetPath(kubeletRoot, p); !ok {
+			continue
+		}
+
+		if o := srv.checkOrphanTargetDir(p, owned[p], mounted); o != nil {
+			orphans = append(orphans, *o)
+		}
+	}
+
+	return orphans, nil
+}
+
+// ownedTargetPaths returns target paths we know were created for our volumes,
+// mapped to their volume IDs. These are target paths of published volumes in
+// the mount cache, and of publish and unpublish operations in the journal.
+func (srv *Server) ownedTargetPaths() (map[string]string, error) {
+	owned := make(map[string]string)
+
+	if srv.mountCache != nil {
+		entries, err := srv.mountCache.ListPublished()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mount cache: %v", err)
+		}
+
+		for i := range entries {
+			owned[entries[i].TargetPath] = entries[i].VolumeID
+		}
+	}
+
+	if srv.journal != nil {
+		entries, err := srv.journal.Pending()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal: %v", err)
+		}
+
+		for _, e := range entries {
+			if e.TargetPath != "" {
+				owned[e.TargetPath] = e.VolumeID
+			}
+		}
+	}
+
+	return owned, nil
+}
+
+func (srv *Server) checkOrphanTargetDir(targetPath, volumeID string, mounted map[string]struct{}) *orphan {
+	if _, ok := mounted[targetPath]; ok || srv.volumes.tracks(targetPath) || hasVolData(targetPath) {
+		return nil
+	}
+
+	fi, err := os.Lstat(targetPath)
+	if err != nil || !fi.IsDir() || time.Since(fi.ModTime()) < orphanTargetDirGracePeriod {
+		return nil
+	}
+
+	if empty, err := isDirEmpty(targetPath); err != nil || !empty {
+		return nil
+	}
+
+	return &orphan{path: targetPath, kind: orphanTargetDir, reason: "vol_data.json is missing", volumeID: volumeID}
+}
+
+// collectOrphan unmounts and removes orphan o. The orphan is checked again
+// while holding its path, in case it was picked up by a node RPC meanwhile.
+func (srv *Server) collectOrphan(ctx context.Context, kubeletRoot string, o *orphan) error {
+	done, err := srv.startPathOperation(o.path)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	mnt, err := mountutils.GetMountInfo(o.path)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table entry: %v", err)
+	}
+
+	switch o.kind {
+	case orphanTargetDir:
+		owned, err := srv.ownedTargetPaths()
+		if err != nil {
+			return err
+		}
+
+		if volumeID, ok := owned[o.path]; !ok || volumeID != o.volumeID ||
+			srv.checkOrphanTargetDir(o.path, o.volumeID, mountedSet(mnt)) == nil {
+			return errors.New("not orphaned anymore")
+		}
+
+		if err := removeEmptyDirs(o.path); err != nil {
+			return err
+		}
+
+		if srv.mountCache != nil {
+			if err := srv.mountCache.RemovePublished(o.volumeID, o.path); err != nil {
+				return fmt.Errorf("failed to remove publish mount cache entry: %v", err)
+			}
+		}
+
+		return nil
+
+	case orphanTargetMount:
+		if mnt == nil || mnt.FSType != dummyFuseFSType || srv.checkOrphanMount(kubeletRoot, o.path) == nil {
+			return errors.New("not orphaned anymore")
+		}
+
+		// This may be an ephemeral volume with dummy-fuse mounted directly in
+		// the target path, as well as a bind mount. Recursive unmount works
+		// for both, without aborting FUSE connections shared with other mounts.
+		if err := recursiveUnmount(ctx, o.path); err != nil {
+			return err
+		}
+
+		return removeEmptyDirs(o.path)
+
+	case orphanStagingMount:
+		if mnt == nil || mnt.FSType != dummyFuseFSType || srv.checkOrphanMount(kubeletRoot, o.path) == nil {
+			return errors.New("not orphaned anymore")
+		}
+
+		// Don't break volumes that are still published from this staging path.
+		binds, err := mountutils.GetBindMounts(o.path)
+		if err != nil {
+			return fmt.Errorf("failed to look for bind mounts: %v", err)
+		}
+		if len(binds) > 0 {
+			return fmt.Errorf("still referenced by %d bind mounts, e.g. %s", len(binds), binds[0].Mountpoint)
+		}
+
+		if err := mountutils.UnmountEscalating(ctx, o.path, 0); err != nil {
+			return err
+		}
+
+		return removeEmptyDirs(o.path)
+	}
+
+	return fmt.Errorf("unknown orphan kind %s", o.kind)
+}
+
+func mountedSet(mnt *mountinfo.Info) map[string]struct{} {
+	if mnt == nil {
+		return nil
+	}
+
+	return map[string]struct{}{mnt.Mountpoint: {}}
+}
+
+func hasVolData(mountpoint string) bool {
+	return pathExists(path.Join(path.Dir(mountpoint), kubeletstate.VolDataFileName))
+}
+
+func pathExists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func isDirEmpty(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// removeEmptyDirs removes mountpoint, and its parent directory if it's empty.
+// Kubelet normally removes both of them once the volume is gone.
+func removeEmptyDirs(mountpoint string) error {
+	if err := os.Remove(mountpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(path.Dir(mountpoint)); err != nil && !os.IsNotExist(err) && !errors.Is(err, unix.ENOTEMPTY) {
+		return err
+	}
+
+	return nil
+}
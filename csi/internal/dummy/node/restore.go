@@ -0,0 +1,106 @@
+package node
+
+import (
+	"context"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+)
+
+// RestoreMounts replays mount instructions stored in the mount cache,
+// remounting volumes that were staged and published before the node
+// plugin was restarted. Staged volumes are restored first, so that
+// publish bind-mounts have a live source to bind from.
+//
+// Failing to restore a mount is not fatal. Errors are only logged
+// and the remaining entries are still processed.
+func (srv *Server) RestoreMounts() {
+	if srv.mountCache == nil {
+		return
+	}
+
+	stagedEntries, err := srv.mountCache.ListStaged()
+	if err != nil {
+		log.Errorf("Failed to list staged mount cache entries: %v", err)
+	}
+
+	for i := range stagedEntries {
+		e := &stagedEntries[i]
+
+		srv.restoreStagedVolume(&stagedVolume{
+			volumeID:     e.VolumeID,
+			stagingPath:  e.StagingTargetPath,
+			mountOptions: e.MountOptions,
+			cfg:          srv.restoredVolumeConfig(e.VolumeID, e.VolumeAttributes),
+		})
+	}
+
+	publishedEntries, err := srv.mountCache.ListPublished()
+	if err != nil {
+		log.Errorf("Failed to list published mount cache entries: %v", err)
+	}
+
+	for i := range publishedEntries {
+		e := &publishedEntries[i]
+
+		srv.restorePublishedVolume(&publishedVolume{
+			volumeID:     e.VolumeID,
+			stagingPath:  e.StagingTargetPath,
+			targetPath:   e.TargetPath,
+			ephemeral:    e.Ephemeral,
+			mountOptions: e.MountOptions,
+			cfg:          srv.restoredVolumeConfig(e.VolumeID, e.VolumeAttributes),
+		})
+	}
+}
+
+// restoreStagedVolume tracks v and reconciles its staging path.
+func (srv *Server) restoreStagedVolume(v *stagedVolume) {
+	// Track the volume even if it fails to be restored,
+	// so that the health monitor may try again later.
+	srv.volumes.addStaged(v)
+
+	if r, ok := srv.fuseMounter.(fuseReviver); ok {
+		// The FUSE connection may still be alive. Try to start
+		// a new FUSE daemon for it before probing the mountpoint.
+		revived, err := r.revive(context.TODO(), v.volumeID, v.mountOptions)
+		if err != nil {
+			log.Errorf("Failed to revive FUSE daemon for volume %s: %v", v.volumeID, err)
+		} else if revived {
+			log.Infof("Revived FUSE daemon for volume %s", v.volumeID)
+		}
+	}
+
+	if err := srv.reconcileStagingPath(context.TODO(), v.volumeID, v.stagingPath, v.mountOptions); err != nil {
+		log.Errorf("Failed to restore staged volume %s in %s: %v", v.volumeID, v.stagingPath, err)
+		return
+	}
+
+	log.Infof("Successfully restored staged volume %s in %s", v.volumeID, v.stagingPath)
+}
+
+// restorePublishedVolume tracks v and reconciles its target path.
+func (srv *Server) restorePublishedVolume(v *publishedVolume) {
+	srv.volumes.addPublished(v)
+
+	if err := srv.reconcilePublishedVolume(context.TODO(), v); err != nil {
+		log.Errorf("Failed to restore published volume %s in %s: %v", v.volumeID, v.targetPath, err)
+		return
+	}
+
+	log.Infof("Successfully restored published volume %s in %s", v.volumeID, v.targetPath)
+}
+
+// restoredVolumeConfig parses volume attributes stored in the mount cache.
+// Unknown attributes are ignored regardless of strictness, so that a volume
+// that was already mounted is still restored. If the attributes are invalid,
+// default configuration is used.
+func (srv *Server) restoredVolumeConfig(volumeID string, attrs map[string]string) *volumeattrs.Config {
+	cfg, _, err := volumeattrs.Parse(attrs, false)
+	if err != nil {
+		log.Errorf("Failed to parse stored volume attributes of volume %s, using defaults: %v", volumeID, err)
+		return volumeattrs.Default()
+	}
+
+	return cfg
+}
@@ -0,0 +1,146 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+// UnstagePolicy defines how NodeUnstageVolume handles staging paths
+// that are still referenced by published volumes.
+type UnstagePolicy string
+
+const (
+	// UnstagePolicyRefuse fails NodeUnstageVolume with FailedPrecondition.
+	UnstagePolicyRefuse UnstagePolicy = "refuse"
+	// UnstagePolicyCleanup unpublishes the referencing volumes first.
+	UnstagePolicyCleanup UnstagePolicy = "cleanup"
+)
+
+// ParseUnstagePolicy returns UnstagePolicy named s.
+func ParseUnstagePolicy(s string) (UnstagePolicy, error) {
+	switch p := UnstagePolicy(s); p {
+	case UnstagePolicyRefuse, UnstagePolicyCleanup:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown unstage policy %q, must be one of %s, %s",
+			s, UnstagePolicyRefuse, UnstagePolicyCleanup)
+	}
+}
+
+// stagingReferences returns target paths of volumes published from stagingPath.
+// These are bind mounts of the staging mount found in the mount table, as well
+// as tracked published volumes, whose bind mounts may have a different source
+// device if the staging mount was remounted since they were published.
+func (srv *Server) stagingReferences(stagingPath string) ([]string, error) {
+	refs := make(map[string]struct{})
+
+	binds, err := mountutils.GetBindMounts(stagingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	for _, m := range binds {
+		refs[m.Mountpoint] = struct{}{}
+	}
+
+	_, published := srv.volumes.snapshot()
+	for i := range published {
+		if !published[i].ephemeral && published[i].stagingPath == stagingPath {
+			refs[published[i].targetPath] = struct{}{}
+		}
+	}
+
+	targets := make([]string, 0, len(refs))
+	for t := range refs {
+		targets = append(targets, t)
+	}
+
+	sort.Strings(targets)
+
+	return targets, nil
+}
+
+// cleanupPublished unmounts and forgets volumeID published in targetPath.
+// The target path directory is left to be removed by NodeUnpublishVolume.
+func (srv *Server) cleanupPublished(ctx context.Context, volumeID, targetPath string) error {
+	mnt, err := mountutils.GetMountInfo(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table entry of %s: %v", targetPath, err)
+	}
+
+	if mnt != nil {
+		if err := srv.unmountPublishPath(ctx, targetPath, mnt); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", targetPath, err)
+		}
+	}
+
+	srv.volumes.removePublished(targetPath)
+
+	if srv.mountCache != nil {
+		if err := srv.mountCache.RemovePublished(volumeID, targetPath); err != nil {
+			return fmt.Errorf("failed to remove publish mount cache entry for %s: %v", targetPath, err)
+		}
+	}
+
+	return nil
+}
+
+// logVolumeReferences logs all tracked volumes, and publish targets that reference
+// each staging path.
+func (srv *Server) logVolumeReferences() {
+	staged, published := srv.volumes.snapshot()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Node volume state: %d staged, %d published volumes", len(staged), len(published))
+
+	for i := range staged {
+		v := &staged[i]
+		refs, err := srv.stagingReferences(v.stagingPath)
+		if err != nil {
+			fmt.Fprintf(&b, "\n  staged %s in %s: failed to get references: %v", v.volumeID, v.stagingPath, err)
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n  staged %s in %s, referenced by %d targets", v.volumeID, v.stagingPath, len(refs))
+		for _, ref := range refs {
+			fmt.Fprintf(&b, "\n    %s", ref)
+		}
+	}
+
+	for i := range published {
+		v := &published[i]
+		if v.ephemeral {
+			fmt.Fprintf(&b, "\n  published ephemeral %s in %s", v.volumeID, v.targetPath)
+		} else {
+			fmt.Fprintf(&b, "\n  published %s in %s from %s", v.volumeID, v.targetPath, v.stagingPath)
+		}
+	}
+
+	log.Infof("%s", b.String())
+}
+
+// StartStateDumper starts a background goroutine that logs tracked volumes,
+// their staging path references and supervised dummy-fuse processes whenever
+// the process receives SIGUSR1.
+func (srv *Server) StartStateDumper() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	go func() {
+		for range c {
+			srv.logVolumeReferences()
+
+			if m, ok := srv.fuseMounter.(*localFuseMounter); ok {
+				m.sup.logProcesses()
+			}
+		}
+	}()
+}
@@ -0,0 +1,539 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	goexec "os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/exec"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/fuselog"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+// dummy-fuse processes of localFuseMounter run in the foreground as children
+// of the node plugin. The supervisor keeps track of them, and restarts them
+// according to the restart policy when they exit while their volume is still
+// mounted. A restart replaces the broken FUSE mount with a new one. Bind mounts
+// of the old mount in publish target paths are left for the health monitor
+// to reconcile.
+
+type (
+	// RestartPolicy defines when are exited dummy-fuse processes restarted.
+	RestartPolicy string
+
+	// fuseExit records how a dummy-fuse process exited.
+	fuseExit struct {
+		at     time.Time
+		status string
+	}
+
+	// fuseProcess is a supervised dummy-fuse process serving a single mountpoint.
+	fuseProcess struct {
+		volumeID   string
+		mountpoint string
+		opts       []string
+
+		// mu serializes (re)starting the process with stopping it.
+		mu       sync.Mutex
+		stopping bool
+		stopCh   chan struct{}
+
+		// Guarded by fuseSupervisor.mu.
+		pid       int
+		startedAt time.Time
+		restarts  int
+		lastExit  *fuseExit
+	}
+
+	fuseSupervisor struct {
+		policy RestartPolicy
+		// If set, output of dummy-fuse processes is stored also in per-volume log files.
+		logs *fuselog.Store
+
+		mu    sync.Mutex
+		procs map[string]*fuseProcess // Keyed by mountpoint.
+	}
+)
+
+const (
+	// RestartNever never restarts dummy-fuse processes.
+	RestartNever RestartPolicy = "never"
+	// RestartOnFailure restarts dummy-fuse processes that exited with non-zero status.
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartAlways restarts dummy-fuse processes whenever they exit,
+	// unless their volume is being unmounted.
+	RestartAlways RestartPolicy = "always"
+)
+
+const (
+	// Restart backoff doubles with each consecutive restart, up to restartBackoffMax.
+	restartBackoffBase = time.Second
+	restartBackoffMax  = time.Minute
+
+	// Processes that ran at least this long have their backoff reset.
+	restartBackoffReset = 5 * time.Minute
+
+	// How long to wait for a started dummy-fuse to mount.
+	fuseMountTimeout = 10 * time.Second
+
+	// How long to wait for dummy-fuse to exit after its mount was unmounted.
+	fuseExitTimeout = 5 * time.Second
+
+	// Expired dummy-fuse logs are looked for at most this often.
+	fuseLogCleanupInterval = time.Hour
+)
+
+// ParseRestartPolicy returns the RestartPolicy named s.
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	switch p := RestartPolicy(s); p {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown restart policy %q, expected one of %s, %s, %s",
+			s, RestartNever, RestartOnFailure, RestartAlways)
+	}
+}
+
+func newFuseSupervisor(policy RestartPolicy, logs *fuselog.Store) *fuseSupervisor {
+	if policy == "" {
+		policy = RestartNever
+	}
+
+	return &fuseSupervisor{
+		policy: policy,
+		logs:   logs,
+		procs:  make(map[string]*fuseProcess),
+	}
+}
+
+// start runs dummy-fuse for volumeID in mountpoint and waits until it's mounted.
+// Once mounted, the process is supervised until stop is called for mountpoint.
+func (s *fuseSupervisor) start(ctx context.Context, volumeID, mountpoint string, opts []string) error {
+	s.mu.Lock()
+	prev := s.procs[mountpoint]
+	s.mu.Unlock()
+
+	if prev != nil {
+		// The mountpoint is being mounted anew, e.g. during reconciliation.
+		// The previous process, if it's still around, no longer serves it.
+		prev.stop()
+	}
+
+	p := &fuseProcess{
+		volumeID:   volumeID,
+		mountpoint: mountpoint,
+		opts:       opts,
+		stopCh:     make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	exited, err := s.launch(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.procs[mountpoint] = p
+	s.mu.Unlock()
+
+	go s.supervise(p, exited)
+
+	return nil
+}
+
+// stop stops supervising mountpoint, so that its dummy-fuse process is not
+// restarted when it exits. The caller is expected to unmount mountpoint,
+// and then call waitExited.
+func (s *fuseSupervisor) stop(mountpoint string) {
+	s.mu.Lock()
+	p := s.procs[mountpoint]
+	s.mu.Unlock()
+
+	if p != nil {
+		p.stop()
+	}
+}
+
+// waitExited waits for dummy-fuse process in mountpoint to exit after it was
+// unmounted. If it doesn't exit in time, it's killed.
+func (s *fuseSupervisor) waitExited(mountpoint string) {
+	s.mu.Lock()
+	p := s.procs[mountpoint]
+	s.mu.Unlock()
+
+	if p == nil {
+		return
+	}
+
+	deadline := time.Now().Add(fuseExitTimeout)
+
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		pid := p.pid
+		s.mu.Unlock()
+
+		if pid == 0 {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p.pid != 0 {
+		log.Warningf("dummy-fuse for volume %s (PID %d) didn't exit after unmount, killing it", p.volumeID, p.pid)
+		_ = syscall.Kill(p.pid, syscall.SIGKILL)
+	}
+
+	if s.procs[mountpoint] == p {
+		delete(s.procs, mountpoint)
+	}
+}
+
+func (p *fuseProcess) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.stopping {
+		p.stopping = true
+		close(p.stopCh)
+	}
+}
+
+// launch starts a new dummy-fuse process for p and waits until it mounts.
+// The returned channel receives the process' exit error once it exits.
+// Must be called with p.mu held.
+func (s *fuseSupervisor) launch(ctx context.Context, p *fuseProcess) (<-chan error, error) {
+	prevMnt, err := mountutils.GetMountInfo(p.mountpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	prevMntID := -1
+	if prevMnt != nil {
+		prevMntID = prevMnt.ID
+	}
+
+	volLog := s.openVolumeLog(p.volumeID)
+
+	cmd := goexec.Command("dummy-fuse", append([]string{"-f"}, dummyFuseArgs(p.mountpoint, p.opts)...)...)
+
+	wait, err := exec.StartAndDoCombined(cmd, func(execID uint64, line string) {
+		log.Infof("dummy-fuse[volume %s]: %s", p.volumeID, line)
+		volLog.writeLine(line)
+	})
+	if err != nil {
+		volLog.writeLine(fmt.Sprintf("--- failed to start dummy-fuse: %v", err))
+		volLog.close()
+		return nil, fmt.Errorf("failed to start dummy-fuse: %v", err)
+	}
+
+	volLog.writeLine(fmt.Sprintf("--- started dummy-fuse with PID %d: %v", cmd.Process.Pid, cmd.Args))
+
+	s.mu.Lock()
+	p.pid = cmd.Process.Pid
+	p.startedAt = time.Now()
+	s.mu.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		err := wait()
+		volLog.writeLine(fmt.Sprintf("--- dummy-fuse exited: %s", exitStatus(err)))
+		volLog.close()
+		exited <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, fuseMountTimeout)
+	defer cancel()
+
+	t := time.NewTicker(20 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		select {
+		case exitErr := <-exited:
+			s.recordExit(p, exitErr)
+			return nil, fmt.Errorf("dummy-fuse exited before mounting %s: %s", p.mountpoint, exitStatus(exitErr))
+		case <-ctx.Done():
+			_ = cmd.Process.Kill()
+			s.recordExit(p, <-exited)
+			return nil, fmt.Errorf("dummy-fuse didn't mount %s: %w", p.mountpoint, ctx.Err())
+		case <-t.C:
+		}
+
+		mnt, err := mountutils.GetMountInfo(p.mountpoint)
+		if err != nil {
+			log.Errorf("Failed to read mount table: %v", err)
+			continue
+		}
+
+		if mnt != nil && mnt.ID != prevMntID && mnt.FSType == dummyFuseFSType {
+			return exited, nil
+		}
+	}
+}
+
+// supervise waits for p's process to exit and restarts it according to the restart policy.
+func (s *fuseSupervisor) supervise(p *fuseProcess, exited <-chan error) {
+	backoff := restartBackoffBase
+
+	for {
+		exitErr := <-exited
+		ranFor := s.recordExit(p, exitErr)
+
+		if !s.shouldRestart(p, exitErr) {
+			s.giveUp(p)
+			return
+		}
+
+		if ranFor >= restartBackoffReset {
+			backoff = restartBackoffBase
+		}
+
+		log.Warningf("dummy-fuse for volume %s in %s exited (%v), restarting in %s",
+			p.volumeID, p.mountpoint, exitStatus(exitErr), backoff)
+
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+
+		var err error
+		if exited, err = s.restart(p); err != nil {
+			if errors.Is(err, errSupervisionStopped) {
+				return
+			}
+
+			log.Errorf("Failed to restart dummy-fuse for volume %s in %s: %v", p.volumeID, p.mountpoint, err)
+
+			// Try again after backoff.
+			failed := make(chan error, 1)
+			failed <- err
+			exited = failed
+		}
+	}
+}
+
+var errSupervisionStopped = errors.New("supervision stopped")
+
+// restart replaces the broken mount in p's mountpoint with a new dummy-fuse process.
+func (s *fuseSupervisor) restart(p *fuseProcess) (<-chan error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopping {
+		return nil, errSupervisionStopped
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fuseMountTimeout)
+	defer cancel()
+
+	if err := mountutils.UnmountEscalating(ctx, p.mountpoint, 0); err != nil {
+		return nil, fmt.Errorf("failed to unmount %s: %v", p.mountpoint, err)
+	}
+
+	exited, err := s.launch(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	p.restarts++
+	s.mu.Unlock()
+
+	log.Infof("Restarted dummy-fuse for volume %s in %s", p.volumeID, p.mountpoint)
+
+	return exited, nil
+}
+
+func (s *fuseSupervisor) shouldRestart(p *fuseProcess, exitErr error) bool {
+	p.mu.Lock()
+	stopping := p.stopping
+	p.mu.Unlock()
+
+	if stopping {
+		return false
+	}
+
+	switch s.policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitErr != nil
+	default:
+		return false
+	}
+}
+
+// recordExit records exit of p's process, and returns how long it ran.
+func (s *fuseSupervisor) recordExit(p *fuseProcess, exitErr error) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.pid = 0
+	p.lastExit = &fuseExit{
+		at:     time.Now(),
+		status: exitStatus(exitErr),
+	}
+
+	return p.lastExit.at.Sub(p.startedAt)
+}
+
+// giveUp logs that p's process won't be restarted anymore. The record
+// is kept until the mountpoint is unmounted, see waitExited.
+func (s *fuseSupervisor) giveUp(p *fuseProcess) {
+	p.mu.Lock()
+	stopping := p.stopping
+	p.mu.Unlock()
+
+	if stopping {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Infof("dummy-fuse for volume %s in %s exited (%s), not restarting with %s restart policy",
+		p.volumeID, p.mountpoint, p.lastExit.status, s.policy)
+}
+
+// logProcesses logs the state of all supervised dummy-fuse processes.
+func (s *fuseSupervisor) logProcesses() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mountpoints := make([]string, 0, len(s.procs))
+	for mp := range s.procs {
+		mountpoints = append(mountpoints, mp)
+	}
+	sort.Strings(mountpoints)
+
+	log.Infof("Supervised dummy-fuse processes (restart policy %s): %d", s.policy, len(mountpoints))
+
+	for _, mp := range mountpoints {
+		p := s.procs[mp]
+
+		lastExit := "none"
+		if p.lastExit != nil {
+			lastExit = fmt.Sprintf("%s at %s", p.lastExit.status, p.lastExit.at.Format(time.RFC3339))
+		}
+
+		if p.pid != 0 {
+			log.Infof("  volume %s in %s: PID %d, started at %s, restarts %d, last exit %s",
+				p.volumeID, mp, p.pid, p.startedAt.Format(time.RFC3339), p.restarts, lastExit)
+		} else {
+			log.Infof("  volume %s in %s: not running, restarts %d, last exit %s",
+				p.volumeID, mp, p.restarts, lastExit)
+		}
+	}
+}
+
+// volumeLog is a log file writer that tolerates failures, which are only logged.
+// The zero value discards all writes.
+type volumeLog struct {
+	volumeID string
+	w        *fuselog.Writer
+}
+
+func (s *fuseSupervisor) openVolumeLog(volumeID string) volumeLog {
+	if s.logs == nil {
+		return volumeLog{}
+	}
+
+	w, err := s.logs.Writer(volumeID)
+	if err != nil {
+		log.Errorf("Failed to open dummy-fuse log of volume %s: %v", volumeID, err)
+		return volumeLog{}
+	}
+
+	return volumeLog{volumeID: volumeID, w: w}
+}
+
+// StartFuseLogCleanup starts a background goroutine that removes expired
+// dummy-fuse logs right away, and then periodically. It is a no-op unless
+// dummy-fuse processes are supervised by the node plugin, and their logs
+// expire.
+func (srv *Server) StartFuseLogCleanup() {
+	m, ok := srv.fuseMounter.(*localFuseMounter)
+	if !ok || m.sup.logs == nil || m.sup.logs.MaxAge() <= 0 {
+		return
+	}
+
+	interval := m.sup.logs.MaxAge()
+	if interval > fuseLogCleanupInterval {
+		interval = fuseLogCleanupInterval
+	}
+
+	go func() {
+		log.Infof("Starting dummy-fuse log cleanup (max age: %s, interval: %s)", m.sup.logs.MaxAge(), interval)
+
+		m.sup.removeExpiredLogs()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for range t.C {
+			m.sup.removeExpiredLogs()
+		}
+	}()
+}
+
+// removeExpiredLogs removes expired logs of volumes that have no supervised
+// dummy-fuse process.
+func (s *fuseSupervisor) removeExpiredLogs() {
+	s.mu.Lock()
+	active := make([]string, 0, len(s.procs))
+	for _, p := range s.procs {
+		active = append(active, p.volumeID)
+	}
+	s.mu.Unlock()
+
+	removed, err := s.logs.RemoveExpired(active)
+	if err != nil {
+		log.Errorf("Failed to remove expired dummy-fuse logs: %v", err)
+	}
+
+	if removed > 0 {
+		log.Infof("Removed %d expired dummy-fuse logs", removed)
+	}
+}
+
+func (l volumeLog) writeLine(line string) {
+	if l.w == nil {
+		return
+	}
+
+	if err := l.w.WriteLine(line); err != nil {
+		log.Errorf("Failed to write dummy-fuse log of volume %s: %v", l.volumeID, err)
+	}
+}
+
+func (l volumeLog) close() {
+	if l.w != nil {
+		l.w.Close()
+	}
+}
+
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,153 @@
+package node
+
+import (
+	"sync"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volumeattrs"
+)
+
+type (
+	stagedVolume struct {
+		volumeID    string
+		stagingPath string
+
+		// FUSE mount options of the staging mount.
+		mountOptions []string
+
+		cfg *volumeattrs.Config
+	}
+
+	publishedVolume struct {
+		volumeID    string
+		stagingPath string
+		targetPath  string
+
+		// Mount flags of the target path bind mount, or FUSE
+		// mount options for ephemeral volumes.
+		mountOptions []string
+
+		cfg *volumeattrs.Config
+
+		// Ephemeral volumes have no staging path, dummy-fuse
+		// is mounted directly into the target path.
+		ephemeral bool
+	}
+
+	// volumeTracker keeps track of volumes that are staged
+	// and published on this node.
+	volumeTracker struct {
+		mu sync.Mutex
+
+		// Staged volumes, keyed by their staging path.
+		staged map[string]*stagedVolume
+
+		// Published volumes, keyed by their target path.
+		published map[string]*publishedVolume
+	}
+)
+
+func newVolumeTracker() *volumeTracker {
+	return &volumeTracker{
+		staged:    make(map[string]*stagedVolume),
+		published: make(map[string]*publishedVolume),
+	}
+}
+
+func (t *volumeTracker) addStaged(v *stagedVolume) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.staged[v.stagingPath] = v
+}
+
+func (t *volumeTracker) removeStaged(stagingPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.staged, stagingPath)
+}
+
+func (t *volumeTracker) addPublished(v *publishedVolume) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.published[v.targetPath] = v
+}
+
+// tracks reports whether p is a staging path or a target path of a tracked volume.
+func (t *volumeTracker) tracks(p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, staged := t.staged[p]
+	_, published := t.published[p]
+
+	return staged || published
+}
+
+// tracksVolume reports whether p is a staging path or a target path of tracked volume volumeID.
+func (t *volumeTracker) tracksVolume(volumeID, p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok := t.staged[p]; ok && v.volumeID == volumeID {
+		return true
+	}
+
+	if v, ok := t.published[p]; ok && v.volumeID == volumeID {
+		return true
+	}
+
+	return false
+}
+
+// getStaged returns a copy of staged volume in stagingPath, or nil if there's no such volume.
+func (t *volumeTracker) getStaged(stagingPath string) *stagedVolume {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok := t.staged[stagingPath]; ok {
+		vCopy := *v
+		return &vCopy
+	}
+
+	return nil
+}
+
+// getPublished returns a copy of published volume in targetPath, or nil if there's no such volume.
+func (t *volumeTracker) getPublished(targetPath string) *publishedVolume {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok := t.published[targetPath]; ok {
+		vCopy := *v
+		return &vCopy
+	}
+
+	return nil
+}
+
+func (t *volumeTracker) removePublished(targetPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.published, targetPath)
+}
+
+// snapshot returns copies of all currently tracked volumes.
+func (t *volumeTracker) snapshot() ([]stagedVolume, []publishedVolume) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	staged := make([]stagedVolume, 0, len(t.staged))
+	for _, v := range t.staged {
+		staged = append(staged, *v)
+	}
+
+	published := make([]publishedVolume, 0, len(t.published))
+	for _, v := range t.published {
+		published = append(published, *v)
+	}
+
+	return staged, published
+}
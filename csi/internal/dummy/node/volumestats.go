@@ -0,0 +1,69 @@
+package node
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+)
+
+// getVolumeUsage returns byte and inode usage of the file-system mounted in volPath.
+func getVolumeUsage(volPath string) ([]*csi.VolumeUsage, error) {
+	var st unix.Statfs_t
+	if err := mountutils.Statfs(volPath, &st); err != nil {
+		return nil, err
+	}
+
+	bsize := int64(st.Bsize)
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(st.Blocks) * bsize,
+			Available: int64(st.Bavail) * bsize,
+			Used:      int64(st.Blocks-st.Bfree) * bsize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.Files),
+			Available: int64(st.Ffree),
+			Used:      int64(st.Files - st.Ffree),
+		},
+	}, nil
+}
+
+// mountExpectations returns how a healthy mount in volPath looks like,
+// based on what we know about the volume published there.
+func (srv *Server) mountExpectations(volPath string) *mountutils.Expectations {
+	expect := &mountutils.Expectations{FSType: dummyFuseFSType}
+
+	v := srv.volumes.getPublished(volPath)
+	if v == nil {
+		return expect
+	}
+
+	fuseOpts := v.mountOptions
+	if !v.ephemeral {
+		expect.BindSource = v.stagingPath
+
+		if staged := srv.volumes.getStaged(v.stagingPath); staged != nil {
+			fuseOpts = staged.mountOptions
+		} else {
+			fuseOpts = nil
+		}
+	}
+
+	expect.ReadWrite = hasBackingDir(fuseOpts) && !containsString(v.mountOptions, "ro")
+
+	return expect
+}
+
+func containsString(ss []string, s string) bool {
+	for i := range ss {
+		if ss[i] == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+// Context-aware variants of the wrappers above. The command is started in its own
+// process group. If ctx is done before the command exits, the whole process group
+// is killed, and the returned error wraps ctx.Err(). Processes that outlive the
+// command (e.g. daemonized FUSE processes) are not affected once the command exits.
+
+func RunContext(ctx context.Context, cmd *exec.Cmd) error {
+	c := atomic.AddUint64(&execCounter, 1)
+	log.InfofDepth(2, FmtLogMsg(c, "Running command env=%v prog=%s cmd=%v"), cmd.Env, cmd.Path, cmd.Args)
+
+	err := runContext(ctx, cmd)
+	log.InfofDepth(2, FmtLogMsg(c, "Process exited: %s"), cmd.ProcessState)
+
+	if err != nil {
+		log.ErrorfDepth(2, FmtLogMsg(c, "Error: %v"), err)
+	}
+
+	return err
+}
+
+func OutputContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	c := atomic.AddUint64(&execCounter, 1)
+	log.InfofDepth(2, FmtLogMsg(c, "Running command env=%v prog=%s args=%v"), cmd.Env, cmd.Path, cmd.Args)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := runContext(ctx, cmd)
+	log.InfofDepth(2, FmtLogMsg(c, "Process exited: %s"), cmd.ProcessState)
+
+	if err != nil {
+		log.ErrorfDepth(2, FmtLogMsg(c, "Error: %v"), err)
+	}
+
+	return stdout.Bytes(), err
+}
+
+func CombinedOutputContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	c := atomic.AddUint64(&execCounter, 1)
+	log.InfofDepth(2, FmtLogMsg(c, "Running command env=%v prog=%s args=%v"), cmd.Env, cmd.Path, cmd.Args)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := runContext(ctx, cmd)
+	log.InfofDepth(2, FmtLogMsg(c, "Process exited: %s"), cmd.ProcessState)
+
+	if err != nil {
+		log.ErrorfDepth(2, FmtLogMsg(c, "Error: %v; Output: %s"), err, out.Bytes())
+	}
+
+	return out.Bytes(), err
+}
+
+func RunAndDoCombinedContext(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	eachCombinedOutLine func(execID uint64, line string),
+) error {
+	c := atomic.AddUint64(&execCounter, 1)
+	log.InfofDepth(2, FmtLogMsg(c, "Running command env=%v prog=%s args=%v"), cmd.Env, cmd.Path, cmd.Args)
+
+	wr, done := lineWriter(c, eachCombinedOutLine)
+
+	cmd.Stdout = wr
+	cmd.Stderr = wr
+
+	err := runContext(ctx, cmd)
+	wr.Close()
+	<-done
+
+	return err
+}
+
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("command %s not started: %w", cmd.Path, err)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		exited  bool
+		killed  bool
+		waitEnd = make(chan struct{})
+	)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !exited {
+				// Negative pid kills the whole process group.
+				_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				killed = true
+			}
+		case <-waitEnd:
+		}
+	}()
+
+	err := cmd.Wait()
+
+	mu.Lock()
+	exited = true
+	wasKilled := killed
+	mu.Unlock()
+	close(waitEnd)
+
+	if wasKilled {
+		return fmt.Errorf("command %s killed: %w", cmd.Path, ctx.Err())
+	}
+
+	return err
+}
+
+// lineWriter returns a writer that calls eachLine for each line written to it.
+// The returned channel is closed once the writer is closed and all lines were processed.
+func lineWriter(execID uint64, eachLine func(execID uint64, line string)) (io.WriteCloser, <-chan struct{}) {
+	rd, wr := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer rd.Close()
+
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			eachLine(execID, scanner.Text())
+		}
+	}()
+
+	return wr, done
+}
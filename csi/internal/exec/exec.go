@@ -89,3 +89,38 @@ func RunAndDoCombined(cmd *exec.Cmd, eachCombinedOutLine func(execID uint64, lin
 
 	return cmd.Run()
 }
+
+// StartAndDoCombined starts cmd and calls eachCombinedOutLine for each line of its
+// combined output. The returned wait function waits for cmd to exit and for all
+// of its output to be processed. It must be called exactly once.
+func StartAndDoCombined(
+	cmd *exec.Cmd,
+	eachCombinedOutLine func(execID uint64, line string),
+) (wait func() error, err error) {
+	c := atomic.AddUint64(&execCounter, 1)
+	log.InfofDepth(2, FmtLogMsg(c, "Starting command env=%v prog=%s args=%v"), cmd.Env, cmd.Path, cmd.Args)
+
+	wr, done := lineWriter(c, eachCombinedOutLine)
+
+	cmd.Stdout = wr
+	cmd.Stderr = wr
+
+	if err = cmd.Start(); err != nil {
+		wr.Close()
+		<-done
+		log.ErrorfDepth(2, FmtLogMsg(c, "Error: %v"), err)
+		return nil, err
+	}
+
+	log.InfofDepth(2, FmtLogMsg(c, "Process started with PID %d"), cmd.Process.Pid)
+
+	return func() error {
+		err := cmd.Wait()
+		wr.Close()
+		<-done
+
+		log.Infof(FmtLogMsg(c, "Process exited: %s"), cmd.ProcessState)
+
+		return err
+	}, nil
+}
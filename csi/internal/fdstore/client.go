@@ -0,0 +1,93 @@
+package fdstore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Client is an fd keeper client.
+type Client struct {
+	socketPath string
+}
+
+// NewClient creates a new fd keeper client. Each call opens a new
+// connection to the keeper listening on socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+	}
+}
+
+func (c *Client) call(req *request, fd int) (*response, *os.File, error) {
+	conn, err := net.DialUnix(network, nil, &net.UnixAddr{Name: c.socketPath, Net: network})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to fd keeper at %s: %v", c.socketPath, err)
+	}
+	defer conn.Close()
+
+	if err = sendMsg(conn, req, fd); err != nil {
+		return nil, nil, fmt.Errorf("failed to send %s request: %v", req.Op, err)
+	}
+
+	var resp response
+	f, err := recvMsg(conn, &resp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to receive %s response: %v", req.Op, err)
+	}
+
+	if resp.Error != "" {
+		if f != nil {
+			f.Close()
+		}
+
+		if resp.Error == errNotFoundMsg {
+			return nil, nil, ErrNotFound
+		}
+
+		return nil, nil, errors.New(resp.Error)
+	}
+
+	return &resp, f, nil
+}
+
+// Store passes fd to the keeper, storing it under volumeID. Any fd
+// previously stored for that volume is closed. The caller may close
+// its own copy of fd afterwards.
+func (c *Client) Store(volumeID string, fd int) error {
+	_, _, err := c.call(&request{Op: opStore, VolumeID: volumeID}, fd)
+	return err
+}
+
+// Retrieve returns a duplicate of the fd stored under volumeID. The fd
+// remains stored in the keeper. Returns ErrNotFound if there's no such fd.
+func (c *Client) Retrieve(volumeID string) (*os.File, error) {
+	_, f, err := c.call(&request{Op: opRetrieve, VolumeID: volumeID}, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("fd keeper returned no file descriptor for volume %s", volumeID)
+	}
+
+	return f, nil
+}
+
+// Drop closes and forgets the fd stored under volumeID.
+// Dropping an fd that doesn't exist is not an error.
+func (c *Client) Drop(volumeID string) error {
+	_, _, err := c.call(&request{Op: opDrop, VolumeID: volumeID}, -1)
+	return err
+}
+
+// List returns volume IDs of all stored fds.
+func (c *Client) List() ([]string, error) {
+	resp, _, err := c.call(&request{Op: opList}, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.VolumeIDs, nil
+}
@@ -0,0 +1,145 @@
+package fdstore
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+
+	"golang.org/x/sys/unix"
+)
+
+// Keeper holds file descriptors keyed by volume ID. It's meant to run
+// in a long-lived process, so that the file descriptors (e.g. /dev/fuse
+// session fds) outlive the processes that created them.
+type Keeper struct {
+	mu  sync.Mutex
+	fds map[string]*os.File
+}
+
+func NewKeeper() *Keeper {
+	return &Keeper{
+		fds: make(map[string]*os.File),
+	}
+}
+
+// Serve accepts connections on a UNIX domain socket at socketPath and
+// serves client requests. It blocks until the listener fails.
+func (k *Keeper) Serve(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove existing socket %s: %v", socketPath, err)
+	}
+
+	l, err := net.ListenUnix(network, &net.UnixAddr{Name: socketPath, Net: network})
+	if err != nil {
+		return fmt.Errorf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	log.Infof("Listening for connections on %s", l.Addr())
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return fmt.Errorf("accept failed: %v", err)
+		}
+
+		go k.handleConn(conn)
+	}
+}
+
+func (k *Keeper) handleConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	for {
+		var req request
+
+		f, err := recvMsg(conn, &req)
+		if err != nil {
+			// Client closed the connection or sent garbage. Either way we're done.
+			return
+		}
+
+		resp, respF := k.handle(&req, f)
+
+		var respFd = -1
+		if respF != nil {
+			respFd = int(respF.Fd())
+		}
+
+		err = sendMsg(conn, resp, respFd)
+
+		if respF != nil {
+			respF.Close()
+		}
+
+		if err != nil {
+			log.Errorf("Failed to send response for %s %s: %v", req.Op, req.VolumeID, err)
+			return
+		}
+	}
+}
+
+// handle processes req. If the returned *os.File is non-nil, it's a duplicate
+// of a stored fd that should be passed to the client and then closed.
+func (k *Keeper) handle(req *request, f *os.File) (*response, *os.File) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	switch req.Op {
+	case opStore:
+		if f == nil {
+			return &response{Error: "no file descriptor passed"}, nil
+		}
+
+		if old, ok := k.fds[req.VolumeID]; ok {
+			old.Close()
+		}
+
+		k.fds[req.VolumeID] = f
+		log.Infof("Stored fd for volume %s", req.VolumeID)
+
+		return &response{}, nil
+	case opRetrieve:
+		stored, ok := k.fds[req.VolumeID]
+		if !ok {
+			return &response{Error: errNotFoundMsg}, nil
+		}
+
+		// Duplicate the fd so that it stays valid even if
+		// it's dropped while it's being sent to the client.
+		dupFd, err := unix.Dup(int(stored.Fd()))
+		if err != nil {
+			return &response{Error: fmt.Sprintf("failed to duplicate fd: %v", err)}, nil
+		}
+
+		log.Infof("Retrieved fd for volume %s", req.VolumeID)
+
+		return &response{}, os.NewFile(uintptr(dupFd), stored.Name())
+	case opDrop:
+		if stored, ok := k.fds[req.VolumeID]; ok {
+			stored.Close()
+			delete(k.fds, req.VolumeID)
+			log.Infof("Dropped fd for volume %s", req.VolumeID)
+		}
+
+		return &response{}, nil
+	case opList:
+		volIDs := make([]string, 0, len(k.fds))
+		for volID := range k.fds {
+			volIDs = append(volIDs, volID)
+		}
+		sort.Strings(volIDs)
+
+		return &response{VolumeIDs: volIDs}, nil
+	default:
+		if f != nil {
+			f.Close()
+		}
+
+		return &response{Error: fmt.Sprintf("unknown operation %q", req.Op)}, nil
+	}
+}
@@ -0,0 +1,122 @@
+package fdstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The keeper and its clients talk over a SOCK_SEQPACKET UNIX domain socket.
+// Each request and response is a single JSON-encoded packet. File descriptors
+// are passed alongside the packet as SCM_RIGHTS ancillary data.
+
+type (
+	op string
+
+	request struct {
+		Op       op     `json:"op"`
+		VolumeID string `json:"volumeID,omitempty"`
+	}
+
+	response struct {
+		Error     string   `json:"error,omitempty"`
+		VolumeIDs []string `json:"volumeIDs,omitempty"`
+	}
+)
+
+const (
+	opStore    op = "store"
+	opRetrieve op = "retrieve"
+	opDrop     op = "drop"
+	opList     op = "list"
+
+	// Maximum size of a single packet.
+	maxMsgSize = 64 * 1024
+
+	// unixpacket is the Go network name for SOCK_SEQPACKET UNIX domain sockets.
+	network = "unixpacket"
+)
+
+var (
+	// ErrNotFound is returned when there's no fd stored for the requested volume.
+	ErrNotFound = errors.New("no file descriptor stored for volume")
+
+	errNotFoundMsg = ErrNotFound.Error()
+)
+
+// sendMsg sends msg, along with file descriptor fd if it's non-negative.
+func sendMsg(conn *net.UnixConn, msg interface{}, fd int) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var oob []byte
+	if fd >= 0 {
+		oob = unix.UnixRights(fd)
+	}
+
+	_, _, err = conn.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// recvMsg receives a message into msg. If a file descriptor was passed
+// along with the message, it is returned as *os.File, otherwise nil.
+func recvMsg(conn *net.UnixConn, msg interface{}) (*os.File, error) {
+	b := make([]byte, maxMsgSize)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b[:n], msg); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, fmt.Errorf("failed to decode message: %v", err)
+	}
+
+	return f, nil
+}
+
+func parseRights(oob []byte) (*os.File, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %v", err)
+	}
+
+	var fds []int
+	for i := range cmsgs {
+		rights, err := unix.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+
+	if len(fds) == 0 {
+		return nil, nil
+	}
+
+	// We only ever send a single fd. Close any unexpected extras.
+	for _, fd := range fds[1:] {
+		unix.Close(fd)
+	}
+
+	return os.NewFile(uintptr(fds[0]), "fdstore"), nil
+}
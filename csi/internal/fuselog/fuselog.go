@@ -0,0 +1,322 @@
+package fuselog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	goexec "os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/exec"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volid"
+)
+
+// FUSE daemon logs are stored per volume:
+//
+//   <root>/<volume ID>/dummy-fuse.log
+//   <root>/<volume ID>/dummy-fuse.log.1
+//   ...
+//   <root>/<volume ID>/dummy-fuse.log.<MaxFiles-1>
+//
+// Each line is prefixed with a timestamp, so that it can be matched
+// with the node plugin's logs. When the current file reaches MaxSize,
+// it's rotated: older files are shifted by one, and the oldest one
+// is removed. Logs are kept after their volume is unmounted, until
+// they expire, see Opts.MaxAge.
+
+type (
+	// Opts configures a Store.
+	Opts struct {
+		// Dir is the root directory of the log files.
+		Dir string
+
+		// MaxSize is the size in bytes at which a log file is rotated.
+		MaxSize int64
+
+		// MaxFiles is the number of log files retained per volume,
+		// including the current one.
+		MaxFiles int
+
+		// MaxAge is the time after the last write to a volume's log
+		// at which the log expires, see RemoveExpired. Zero keeps logs
+		// forever.
+		MaxAge time.Duration
+	}
+
+	// Store manages log files of FUSE daemons.
+	Store struct {
+		opts Opts
+	}
+
+	// Writer appends lines to the log of a single volume,
+	// rotating its files as needed. It's safe for concurrent use.
+	Writer struct {
+		s        *Store
+		filePath string
+
+		mu   sync.Mutex
+		f    *os.File
+		size int64
+	}
+)
+
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 3
+
+	logFileName = "dummy-fuse.log"
+)
+
+// ErrNotFound is returned by Tail when there's no log for the volume.
+var ErrNotFound = errors.New("volume log not found")
+
+// New creates a log store rooted at opts.Dir. The directory
+// is created if it doesn't exist yet.
+func New(opts *Opts) (*Store, error) {
+	o := *opts
+	if o.MaxSize <= 0 {
+		o.MaxSize = DefaultMaxSize
+	}
+	if o.MaxFiles <= 0 {
+		o.MaxFiles = DefaultMaxFiles
+	}
+
+	if err := os.MkdirAll(o.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create FUSE log directory %s: %v", o.Dir, err)
+	}
+
+	return &Store{opts: o}, nil
+}
+
+// LogPath returns path to the current log file of volumeID.
+func (s *Store) LogPath(volumeID string) string {
+	return path.Join(s.opts.Dir, volid.Escape(volumeID), logFileName)
+}
+
+// Writer opens the log of volumeID for appending. The caller must close it.
+func (s *Store) Writer(volumeID string) (*Writer, error) {
+	p := s.LogPath(volumeID)
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory for volume %s: %v", volumeID, err)
+	}
+
+	w := &Writer{s: s, filePath: p}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// MaxAge returns the age at which logs expire. Zero means they never do.
+func (s *Store) MaxAge() time.Duration {
+	return s.opts.MaxAge
+}
+
+// RemoveExpired removes logs of volumes that were last written to more than
+// MaxAge ago, except for volumes in active. Returns the number of removed logs.
+// It's a no-op if MaxAge is not set.
+func (s *Store) RemoveExpired(active []string) (int, error) {
+	if s.opts.MaxAge <= 0 {
+		return 0, nil
+	}
+
+	keep := make(map[string]bool, len(active))
+	for _, volumeID := range active {
+		keep[volid.Escape(volumeID)] = true
+	}
+
+	dirEntries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read FUSE log directory %s: %v", s.opts.Dir, err)
+	}
+
+	var (
+		removed int
+		errs    []error
+	)
+
+	for _, de := range dirEntries {
+		if !de.IsDir() || keep[de.Name()] {
+			continue
+		}
+
+		dir := path.Join(s.opts.Dir, de.Name())
+
+		lastWrite, err := lastModified(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if time.Since(lastWrite) < s.opts.MaxAge {
+			continue
+		}
+
+		if err = os.RemoveAll(dir); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		removed++
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// lastModified returns the latest modification time of files in dir,
+// or of dir itself if it's empty.
+func lastModified(dir string) (time.Time, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	latest := fi.ModTime()
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, de := range dirEntries {
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// Tail calls eachLine for the last n lines of volumeID's log. If follow is set,
+// it then keeps calling eachLine for new lines, across rotations, until ctx is done.
+func (s *Store) Tail(ctx context.Context, volumeID string, n int, follow bool, eachLine func(line string)) error {
+	p := s.LogPath(volumeID)
+
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, volumeID)
+		}
+		return err
+	}
+
+	args := []string{"-n", strconv.Itoa(n)}
+	if follow {
+		// Follow the file name rather than the descriptor, so that
+		// tail keeps up with rotations.
+		args = append(args, "-F")
+	}
+
+	cmd := goexec.Command("tail", append(args, p)...)
+
+	err := exec.RunAndDoCombinedContext(ctx, cmd, func(_ uint64, line string) {
+		eachLine(line)
+	})
+	if follow && errors.Is(err, ctx.Err()) {
+		// Following ends when ctx is done.
+		return nil
+	}
+
+	return err
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %v", w.filePath, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file %s: %v", w.filePath, err)
+	}
+
+	w.f = f
+	w.size = fi.Size()
+
+	return nil
+}
+
+// WriteLine appends a timestamped line to the log.
+func (w *Writer) WriteLine(line string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return os.ErrClosed
+	}
+
+	b := []byte(time.Now().UTC().Format(time.RFC3339Nano) + " " + line + "\n")
+
+	if w.size > 0 && w.size+int64(len(b)) > w.s.opts.MaxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+
+	return err
+}
+
+// rotate shifts log files by one and opens a new current file.
+// Must be called with w.mu held.
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("failed to close log file %s: %v", w.filePath, err)
+	}
+	w.f = nil
+
+	maxFiles := w.s.opts.MaxFiles
+
+	if err := os.Remove(rotatedPath(w.filePath, maxFiles-1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove oldest log file: %v", err)
+	}
+
+	for i := maxFiles - 2; i >= 0; i-- {
+		err := os.Rename(rotatedPath(w.filePath, i), rotatedPath(w.filePath, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate log file: %v", err)
+		}
+	}
+
+	return w.open()
+}
+
+func rotatedPath(p string, i int) string {
+	if i == 0 {
+		return p
+	}
+
+	return fmt.Sprintf("%s.%d", p, i)
+}
+
+// Close closes the log file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Close()
+	w.f = nil
+
+	return err
+}
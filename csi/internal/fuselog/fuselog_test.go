@@ -0,0 +1,54 @@
+package fuselog
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRemoveExpired(t *testing.T) {
+	s, err := New(&Opts{Dir: t.TempDir(), MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	for _, volumeID := range []string{"expired", "active", "recent"} {
+		w, err := s.Writer(volumeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.WriteLine("hello"); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		if volumeID == "recent" {
+			continue
+		}
+
+		p := s.LogPath(volumeID)
+		for _, f := range []string{p, path.Dir(p)} {
+			if err = os.Chtimes(f, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := s.RemoveExpired([]string{"active"})
+	if err != nil {
+		t.Fatalf("RemoveExpired failed: %v", err)
+	}
+
+	if removed != 1 {
+		t.Errorf("expected 1 removed log, got %d", removed)
+	}
+
+	for volumeID, exists := range map[string]bool{"expired": false, "active": true, "recent": true} {
+		if _, err = os.Stat(s.LogPath(volumeID)); (err == nil) != exists {
+			t.Errorf("expected log of %s to exist: %t, got %v", volumeID, exists, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/atomicfile"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+// Journal is a write-ahead log of node operations. Before an operation
+// changes anything on the node, its record is written into the journal,
+// and once the operation is done, the record is removed. Records that are
+// still in the journal on startup belong to operations that were interrupted,
+// e.g. because the node plugin was killed.
+//
+// Each record is stored in its own file, named after its sequence number:
+//
+//   <root>/<sequence number>
+//
+// Records are written and removed atomically, and fsync'd.
+
+type (
+	// Op is the kind of journaled operation.
+	Op string
+
+	// Record describes a journaled operation.
+	Record struct {
+		// Seq is the sequence number of the record, assigned by Begin.
+		Seq uint64 `json:"seq"`
+
+		Op          Op     `json:"op"`
+		VolumeID    string `json:"volumeID"`
+		StagingPath string `json:"stagingPath,omitempty"`
+		TargetPath  string `json:"targetPath,omitempty"`
+
+		// Request is the operation's request, needed to replay it.
+		Request json.RawMessage `json:"request,omitempty"`
+
+		StartedAt time.Time `json:"startedAt"`
+	}
+
+	// Journal is a persistent store of records of operations in progress.
+	Journal struct {
+		dir string
+
+		mu  sync.Mutex
+		seq uint64
+	}
+
+	// Entry is a record of an operation in progress.
+	Entry struct {
+		j *Journal
+		p string
+
+		Record
+	}
+)
+
+const (
+	OpStage     Op = "stage"
+	OpUnstage   Op = "unstage"
+	OpPublish   Op = "publish"
+	OpUnpublish Op = "unpublish"
+)
+
+// New creates a journal rooted at dir. The directory is created
+// if it doesn't exist yet.
+func New(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory %s: %v", dir, err)
+	}
+
+	// Temporary files are leftovers of Begin calls that didn't finish writing
+	// their records. Their operations didn't start, there's nothing to replay.
+	tmpFiles, err := filepath.Glob(path.Join(dir, "*"+atomicfile.TmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range tmpFiles {
+		os.Remove(p)
+	}
+
+	j := &Journal{dir: dir}
+
+	// Continue numbering after records left from the previous run,
+	// so that they are replayed in the right order with new ones.
+	seqs, err := j.listSeqs()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		j.seq = seqs[len(seqs)-1]
+	}
+
+	return j, nil
+}
+
+func (j *Journal) recordPath(seq uint64) string {
+	return path.Join(j.dir, fmt.Sprintf("%020d", seq))
+}
+
+// Begin persists r in the journal, assigning it a sequence number.
+// Once the operation is done, the returned entry must be committed.
+func (j *Journal) Begin(r *Record) (*Entry, error) {
+	j.mu.Lock()
+	j.seq++
+	seq := j.seq
+	j.mu.Unlock()
+
+	e := &Entry{j: j, p: j.recordPath(seq), Record: *r}
+	e.Seq = seq
+	if e.StartedAt.IsZero() {
+		e.StartedAt = time.Now()
+	}
+
+	b, err := json.Marshal(&e.Record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal journal record: %v", err)
+	}
+
+	if err = atomicfile.Write(e.p, b, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write journal record %s: %v", e.p, err)
+	}
+
+	log.Debugf("Journal: began %s of volume %s (seq %d)", e.Op, e.VolumeID, e.Seq)
+
+	return e, nil
+}
+
+// Commit removes the entry's record from the journal.
+func (e *Entry) Commit() error {
+	if err := atomicfile.Remove(e.p); err != nil {
+		return fmt.Errorf("failed to remove journal record %s: %v", e.p, err)
+	}
+
+	log.Debugf("Journal: committed %s of volume %s (seq %d)", e.Op, e.VolumeID, e.Seq)
+
+	return nil
+}
+
+// Pending returns records of operations that were not committed,
+// ordered by their sequence numbers. Records that cannot be read
+// are logged and skipped.
+func (j *Journal) Pending() ([]*Entry, error) {
+	seqs, err := j.listSeqs()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, seq := range seqs {
+		p := j.recordPath(seq)
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Errorf("Failed to read journal record %s: %v", p, err)
+			continue
+		}
+
+		e := &Entry{j: j, p: p}
+		if err = json.Unmarshal(b, &e.Record); err != nil {
+			log.Errorf("Failed to parse journal record %s: %v", p, err)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func (j *Journal) listSeqs() ([]uint64, error) {
+	dirEntries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal directory %s: %v", j.dir, err)
+	}
+
+	var seqs []uint64
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(de.Name(), atomicfile.TmpSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(de.Name(), 10, 64)
+		if err != nil {
+			log.Warningf("Ignoring unexpected file %s in journal directory %s", de.Name(), j.dir)
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+
+	return seqs, nil
+}
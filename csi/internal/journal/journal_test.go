@@ -0,0 +1,77 @@
+package journal
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/atomicfile"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*Entry
+	for _, op := range []Op{OpStage, OpPublish, OpUnpublish} {
+		e, err := j.Begin(&Record{Op: op, VolumeID: "vol-1"})
+		if err != nil {
+			t.Fatalf("Begin failed: %v", err)
+		}
+		entries = append(entries, e)
+	}
+
+	if err = entries[1].Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// A record that was being written when the process was killed.
+	if err = os.WriteFile(path.Join(dir, "00000000000000000004"+atomicfile.TmpSuffix), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the journal, like on the next startup.
+	j, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(path.Join(dir, "00000000000000000004"+atomicfile.TmpSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be removed, got %v", err)
+	}
+
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+
+	if len(pending) != 2 ||
+		pending[0].Seq != 1 || pending[0].Op != OpStage ||
+		pending[1].Seq != 3 || pending[1].Op != OpUnpublish {
+		t.Fatalf("expected records 1 (stage) and 3 (unpublish) to be pending, got %+v", pending)
+	}
+
+	// Numbering continues after records left from the previous run.
+	e, err := j.Begin(&Record{Op: OpUnstage, VolumeID: "vol-1"})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+
+	if e.Seq != 4 {
+		t.Errorf("expected sequence number 4, got %d", e.Seq)
+	}
+
+	for _, e := range append(pending, e) {
+		if err = e.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+
+	if pending, err = j.Pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending records, got %+v (%v)", pending, err)
+	}
+}
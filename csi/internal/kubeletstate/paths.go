@@ -0,0 +1,86 @@
+package kubeletstate
+
+import (
+	"path"
+	"strings"
+)
+
+// Kubelet's on-disk layout of CSI volumes, relative to its root directory:
+//
+//   pods/<pod UID>/volumes/kubernetes.io~csi/<volume name>/mount
+//     Target path of a published volume.
+//
+//   plugins/kubernetes.io/csi/pv/<PV name>/globalmount
+//   plugins/kubernetes.io/csi/<driver name>/<volume handle hash>/globalmount
+//     Staging path of a volume, depending on kubelet version.
+//
+// In both cases, the volume's vol_data.json is stored in the parent
+// directory of the mountpoint.
+
+const (
+	DefaultRoot = "/var/lib/kubelet"
+
+	// TargetDirName is the name of target paths in volume directories of Pods.
+	TargetDirName = "mount"
+
+	podsDirName       = "pods"
+	csiVolumesDirName = "kubernetes.io~csi"
+	stagingDirName    = "globalmount"
+)
+
+// PodsDir returns path to the directory with Pod volumes.
+func PodsDir(root string) string {
+	return path.Join(root, podsDirName)
+}
+
+// CSIPluginDir returns path to the directory with staging paths of CSI volumes.
+func CSIPluginDir(root string) string {
+	return path.Join(root, "plugins", "kubernetes.io", "csi")
+}
+
+// PodDir returns path to the directory of Pod podUID.
+func PodDir(root, podUID string) string {
+	return path.Join(PodsDir(root), podUID)
+}
+
+// PodCSIVolumesDir returns path to the directory with CSI volumes of Pod podUID.
+func PodCSIVolumesDir(root, podUID string) string {
+	return path.Join(PodDir(root, podUID), "volumes", csiVolumesDirName)
+}
+
+// TargetPath returns the target path of CSI volume volName in Pod podUID.
+func TargetPath(root, podUID, volName string) string {
+	return path.Join(PodCSIVolumesDir(root, podUID), volName, TargetDirName)
+}
+
+// ParseTargetPath returns the Pod UID and volume name of target path p.
+// ok is false if p is not a target path of a CSI volume under root.
+func ParseTargetPath(root, p string) (podUID, volName string, ok bool) {
+	rel, ok := relPath(PodsDir(root), p)
+	if !ok {
+		return "", "", false
+	}
+
+	// <pod UID>/volumes/kubernetes.io~csi/<volume name>/mount
+	parts := strings.Split(rel, "/")
+	if len(parts) != 5 || parts[1] != "volumes" || parts[2] != csiVolumesDirName || parts[4] != TargetDirName {
+		return "", "", false
+	}
+
+	return parts[0], parts[3], true
+}
+
+// IsStagingPath returns true if p is a staging path of a CSI volume under root.
+func IsStagingPath(root, p string) bool {
+	_, ok := relPath(CSIPluginDir(root), p)
+	return ok && path.Base(p) == stagingDirName
+}
+
+func relPath(dir, p string) (string, bool) {
+	p = path.Clean(p)
+	if !strings.HasPrefix(p, dir+"/") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(p, dir+"/"), true
+}
@@ -0,0 +1,129 @@
+package kubeletstate
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+type (
+	// StagedVolume is a volume staged by kubelet.
+	StagedVolume struct {
+		StagingPath string
+		VolData     VolData
+	}
+
+	// PublishedVolume is a volume published by kubelet into a Pod.
+	PublishedVolume struct {
+		PodUID     string
+		TargetPath string
+
+		// StagingPath is the staging path of the volume. It's empty
+		// for ephemeral volumes, and when the volume is not staged.
+		StagingPath string
+
+		VolData VolData
+	}
+
+	// Inventory holds volumes of a CSI driver, as known to kubelet.
+	Inventory struct {
+		Staged    []StagedVolume
+		Published []PublishedVolume
+	}
+)
+
+// Scan builds the inventory of volumes of driverName from vol_data.json files
+// under kubelet root directory. Only the files are read, never the mountpoints.
+//
+// Volumes whose vol_data.json cannot be read are skipped, and the errors are
+// returned together with the rest of the inventory.
+func Scan(root, driverName string) (*Inventory, error) {
+	var (
+		inv  Inventory
+		errs []error
+	)
+
+	stagingDirs, err := globVolDataDirs(
+		// Staging paths named after PVs.
+		path.Join(CSIPluginDir(root), "pv", "*"),
+		// Staging paths named after hashes of volume handles.
+		path.Join(CSIPluginDir(root), driverName, "*"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	stagingPaths := make(map[string]string)
+
+	for _, dir := range stagingDirs {
+		vd, err := ReadVolData(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read volume data in %s: %v", dir, err))
+			continue
+		}
+
+		if vd.DriverName != driverName {
+			continue
+		}
+
+		stagingPath := path.Join(dir, stagingDirName)
+		stagingPaths[vd.VolumeHandle] = stagingPath
+
+		inv.Staged = append(inv.Staged, StagedVolume{
+			StagingPath: stagingPath,
+			VolData:     *vd,
+		})
+	}
+
+	volDirs, err := globVolDataDirs(path.Join(PodCSIVolumesDir(root, "*"), "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range volDirs {
+		vd, err := ReadVolData(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read volume data in %s: %v", dir, err))
+			continue
+		}
+
+		if vd.DriverName != driverName {
+			continue
+		}
+
+		targetPath := path.Join(dir, TargetDirName)
+		podUID, _, _ := ParseTargetPath(root, targetPath)
+
+		v := PublishedVolume{
+			PodUID:     podUID,
+			TargetPath: targetPath,
+			VolData:    *vd,
+		}
+
+		if !vd.IsEphemeral() {
+			v.StagingPath = stagingPaths[vd.VolumeHandle]
+		}
+
+		inv.Published = append(inv.Published, v)
+	}
+
+	return &inv, errors.Join(errs...)
+}
+
+// globVolDataDirs returns directories matching patterns that contain vol_data.json.
+func globVolDataDirs(patterns ...string) ([]string, error) {
+	var dirs []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(path.Join(pattern, VolDataFileName))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			dirs = append(dirs, path.Dir(m))
+		}
+	}
+
+	return dirs, nil
+}
@@ -0,0 +1,54 @@
+package kubeletstate
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// Kubelet stores metadata of each CSI volume it stages or publishes in
+// a vol_data.json file. For published volumes, the file is stored next
+// to the target path:
+//
+//   <kubelet root>/pods/<pod UID>/volumes/kubernetes.io~csi/<volume name>/vol_data.json
+//   <kubelet root>/pods/<pod UID>/volumes/kubernetes.io~csi/<volume name>/mount
+
+type (
+	// VolData is the contents of kubelet's vol_data.json file.
+	VolData struct {
+		SpecVolID           string `json:"specVolID"`
+		VolumeHandle        string `json:"volumeHandle"`
+		DriverName          string `json:"driverName"`
+		NodeName            string `json:"nodeName"`
+		AttachmentID        string `json:"attachmentID,omitempty"`
+		VolumeLifecycleMode string `json:"volumeLifecycleMode,omitempty"`
+	}
+)
+
+const (
+	VolDataFileName = "vol_data.json"
+
+	// Volume lifecycle modes.
+	PersistentVolumeLifecycleMode = "Persistent"
+	EphemeralVolumeLifecycleMode  = "Ephemeral"
+)
+
+// ReadVolData reads vol_data.json stored in dir.
+func ReadVolData(dir string) (*VolData, error) {
+	b, err := os.ReadFile(path.Join(dir, VolDataFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var vd VolData
+	if err = json.Unmarshal(b, &vd); err != nil {
+		return nil, err
+	}
+
+	return &vd, nil
+}
+
+// IsEphemeral returns true if the volume is an ephemeral inline volume.
+func (vd *VolData) IsEphemeral() bool {
+	return vd.VolumeLifecycleMode == EphemeralVolumeLifecycleMode
+}
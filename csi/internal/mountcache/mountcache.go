@@ -0,0 +1,198 @@
+package mountcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/atomicfile"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/volid"
+)
+
+// Mount cache stores mount instructions for staged and published volumes
+// in node-local storage. Each instruction is stored in its own file:
+//
+//   <root>/staged/<volume ID>
+//   <root>/published/<volume ID>.<hash of target path>
+//
+// Files are written atomically, so that the cache stays consistent
+// even if the node plugin is killed in the middle of a write.
+
+type (
+	// StagedEntry holds mount instructions for a NodeStageVolume RPC.
+	StagedEntry struct {
+		VolumeID          string   `json:"volumeID"`
+		StagingTargetPath string   `json:"stagingTargetPath"`
+		MountOptions      []string `json:"mountOptions,omitempty"`
+
+		// VolumeAttributes are the volume context attributes of the volume.
+		VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	}
+
+	// PublishedEntry holds mount instructions for a NodePublishVolume RPC.
+	PublishedEntry struct {
+		VolumeID          string   `json:"volumeID"`
+		StagingTargetPath string   `json:"stagingTargetPath,omitempty"`
+		TargetPath        string   `json:"targetPath"`
+		Ephemeral         bool     `json:"ephemeral,omitempty"`
+		MountOptions      []string `json:"mountOptions,omitempty"`
+
+		// VolumeAttributes are the volume context attributes of the volume.
+		VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	}
+
+	// Cache is a persistent store of mount instructions.
+	Cache struct {
+		stagedDir    string
+		publishedDir string
+	}
+)
+
+const (
+	stagedDirName    = "staged"
+	publishedDirName = "published"
+)
+
+// New creates a mount cache rooted at dir. The directory
+// structure is created if it doesn't exist yet.
+func New(dir string) (*Cache, error) {
+	c := &Cache{
+		stagedDir:    path.Join(dir, stagedDirName),
+		publishedDir: path.Join(dir, publishedDirName),
+	}
+
+	for _, d := range []string{c.stagedDir, c.publishedDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create mount cache directory %s: %v", d, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Cache) stagedEntryPath(volID string) string {
+	return path.Join(c.stagedDir, volid.Escape(volID))
+}
+
+func (c *Cache) publishedEntryPath(volID, targetPath string) string {
+	h := sha256.Sum256([]byte(targetPath))
+	return path.Join(c.publishedDir,
+		fmt.Sprintf("%s.%s", volid.Escape(volID), hex.EncodeToString(h[:8])))
+}
+
+func saveEntry(p string, e interface{}) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mount cache entry: %v", err)
+	}
+
+	return atomicfile.Write(p, b, 0600)
+}
+
+// SaveStaged stores mount instructions for a staged volume.
+func (c *Cache) SaveStaged(e *StagedEntry) error {
+	p := c.stagedEntryPath(e.VolumeID)
+	if err := saveEntry(p, e); err != nil {
+		return err
+	}
+
+	log.Debugf("Saved stage mount entry to %s", p)
+
+	return nil
+}
+
+// RemoveStaged removes mount instructions for a staged volume.
+// Removing an entry that doesn't exist is not an error.
+func (c *Cache) RemoveStaged(volID string) error {
+	return atomicfile.Remove(c.stagedEntryPath(volID))
+}
+
+// SavePublished stores mount instructions for a published volume.
+func (c *Cache) SavePublished(e *PublishedEntry) error {
+	p := c.publishedEntryPath(e.VolumeID, e.TargetPath)
+	if err := saveEntry(p, e); err != nil {
+		return err
+	}
+
+	log.Debugf("Saved publish mount entry to %s", p)
+
+	return nil
+}
+
+// RemovePublished removes mount instructions for a published volume.
+// Removing an entry that doesn't exist is not an error.
+func (c *Cache) RemovePublished(volID, targetPath string) error {
+	return atomicfile.Remove(c.publishedEntryPath(volID, targetPath))
+}
+
+// forEachEntry reads all entries in dir, calling readF for each one.
+// Entries that cannot be read are logged and skipped.
+func forEachEntry(dir string, readF func(b []byte) error) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read mount cache directory %s: %v", dir, err)
+	}
+
+	if len(dirEntries) == 0 {
+		log.Infof("No mount cache entries in %s", dir)
+		return nil
+	}
+
+	for _, de := range dirEntries {
+		if de.IsDir() || strings.HasSuffix(de.Name(), atomicfile.TmpSuffix) {
+			continue
+		}
+
+		p := path.Join(dir, de.Name())
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Errorf("Failed to read mount cache entry %s: %v", p, err)
+			continue
+		}
+
+		if err = readF(b); err != nil {
+			log.Errorf("Failed to parse mount cache entry %s: %v", p, err)
+			continue
+		}
+	}
+
+	return nil
+}
+
+// ListStaged returns all stored staged volume entries.
+func (c *Cache) ListStaged() ([]StagedEntry, error) {
+	var entries []StagedEntry
+
+	err := forEachEntry(c.stagedDir, func(b []byte) error {
+		var e StagedEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+
+	return entries, err
+}
+
+// ListPublished returns all stored published volume entries.
+func (c *Cache) ListPublished() ([]PublishedEntry, error) {
+	var entries []PublishedEntry
+
+	err := forEachEntry(c.publishedDir, func(b []byte) error {
+		var e PublishedEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+
+	return entries, err
+}
@@ -0,0 +1,317 @@
+package mountns
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements replacing stale mounts in mount namespaces of other
+// processes (e.g. containers of consumer Pods) with fresh bind mounts.
+//
+// When a FUSE mount is restored in the node plugin, the bind mounts that
+// were shared with consumer Pods when they started still point to the old,
+// dead FUSE connection. We find these mounts by scanning /proc/*/mountinfo
+// for mounts of the dead connection's device, enter the mount namespace of
+// each such process and replace the stale mount with a detached clone of
+// the restored mount (open_tree(2) + move_mount(2)).
+
+type (
+	// StaleMount is a mount of a dead device in another mount namespace.
+	StaleMount struct {
+		// PID of a process in the mount namespace.
+		PID int
+
+		// MntNS is the mount namespace identifier, e.g. mnt:[4026531840].
+		MntNS string
+
+		// Mountpoint of the stale mount, as seen by the process.
+		Mountpoint string
+
+		// Root of the mount within the file-system.
+		Root string
+	}
+
+	// InjectResult describes outcome of replacing a single stale mount.
+	InjectResult struct {
+		StaleMount
+
+		Err error
+	}
+
+	// NamespaceReport summarizes results of replacing stale mounts
+	// in a single mount namespace.
+	NamespaceReport struct {
+		// MntNS is the mount namespace identifier, e.g. mnt:[4026531840].
+		MntNS string
+
+		// PID of a process in the mount namespace.
+		PID int
+
+		// PodUID is the UID of the Pod the process belongs to,
+		// or empty if it cannot be determined.
+		PodUID string
+
+		// Fixed holds mountpoints that were replaced successfully.
+		Fixed []string
+
+		// Failed holds results of mountpoints that failed to be replaced.
+		Failed []InjectResult
+	}
+)
+
+func (r *InjectResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("pid=%d mntns=%s mountpoint=%s: failed: %v", r.PID, r.MntNS, r.Mountpoint, r.Err)
+	}
+
+	return fmt.Sprintf("pid=%d mntns=%s mountpoint=%s: ok", r.PID, r.MntNS, r.Mountpoint)
+}
+
+func (r *NamespaceReport) String() string {
+	pod := r.PodUID
+	if pod == "" {
+		pod = "<unknown>"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mntns=%s pid=%d pod=%s: fixed %d of %d mounts",
+		r.MntNS, r.PID, pod, len(r.Fixed), len(r.Fixed)+len(r.Failed))
+
+	for i := range r.Failed {
+		fmt.Fprintf(&b, "; %s failed: %v", r.Failed[i].Mountpoint, r.Failed[i].Err)
+	}
+
+	return b.String()
+}
+
+// OK returns true if all stale mounts in the namespace were replaced.
+func (r *NamespaceReport) OK() bool {
+	return len(r.Failed) == 0
+}
+
+func readMntNS(pid string) (string, error) {
+	return os.Readlink(path.Join("/proc", pid, "ns/mnt"))
+}
+
+// FindStaleMounts scans mount tables of all processes and returns mounts
+// of device major:minor. Only a single process is reported per mount
+// namespace. The mount namespace of the calling process is skipped,
+// as well as mounts whose mountpoint is in skipMountpoints.
+func FindStaleMounts(major, minor int, skipMountpoints map[string]struct{}) ([]StaleMount, error) {
+	selfNS, err := readMntNS("self")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read own mount namespace: %v", err)
+	}
+
+	procEntries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		stale  []StaleMount
+		seenNS = map[string]struct{}{selfNS: {}}
+	)
+
+	for _, pe := range procEntries {
+		pid, err := strconv.Atoi(pe.Name())
+		if err != nil {
+			// Not a process directory.
+			continue
+		}
+
+		ns, err := readMntNS(pe.Name())
+		if err != nil {
+			// The process may have exited in the meantime,
+			// or it's a kernel thread.
+			continue
+		}
+
+		if _, ok := seenNS[ns]; ok {
+			continue
+		}
+		seenNS[ns] = struct{}{}
+
+		mnts, err := mountinfo.PidMountInfo(pid)
+		if err != nil {
+			continue
+		}
+
+		for _, m := range mnts {
+			if m.Major != major || m.Minor != minor {
+				continue
+			}
+
+			if _, ok := skipMountpoints[m.Mountpoint]; ok {
+				continue
+			}
+
+			stale = append(stale, StaleMount{
+				PID:        pid,
+				MntNS:      ns,
+				Mountpoint: m.Mountpoint,
+				Root:       m.Root,
+			})
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].PID != stale[j].PID {
+			return stale[i].PID < stale[j].PID
+		}
+		return stale[i].Mountpoint < stale[j].Mountpoint
+	})
+
+	return stale, nil
+}
+
+// Inject replaces each of the stale mounts with a fresh bind mount
+// of sourcePath, and returns a report of the results.
+func Inject(sourcePath string, staleMounts []StaleMount) []InjectResult {
+	results := make([]InjectResult, len(staleMounts))
+
+	for i := range staleMounts {
+		results[i] = InjectResult{
+			StaleMount: staleMounts[i],
+			Err:        inject(sourcePath, &staleMounts[i]),
+		}
+
+		log.Infof("Mount injection: %s", &results[i])
+	}
+
+	return results
+}
+
+// ReportByNamespace groups results by mount namespace, in the order
+// the namespaces first appear in results.
+func ReportByNamespace(results []InjectResult) []NamespaceReport {
+	var (
+		reports []NamespaceReport
+		idx     = make(map[string]int)
+	)
+
+	for i := range results {
+		res := &results[i]
+
+		j, ok := idx[res.MntNS]
+		if !ok {
+			j = len(reports)
+			idx[res.MntNS] = j
+			reports = append(reports, NamespaceReport{
+				MntNS:  res.MntNS,
+				PID:    res.PID,
+				PodUID: podUIDOfPID(res.PID),
+			})
+		}
+
+		if res.Err != nil {
+			reports[j].Failed = append(reports[j].Failed, *res)
+		} else {
+			reports[j].Fixed = append(reports[j].Fixed, res.Mountpoint)
+		}
+	}
+
+	return reports
+}
+
+// Pod cgroups are named after Pod UIDs, e.g. kubepods-besteffort-pod<UID>.slice
+// with systemd cgroup driver (with dashes replaced by underscores), or
+// kubepods/besteffort/pod<UID> with cgroupfs driver.
+var podUIDRe = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// podUIDOfPID returns the UID of the Pod process pid belongs to,
+// or an empty string if it cannot be determined.
+func podUIDOfPID(pid int) string {
+	b, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+
+	m := podUIDRe.FindSubmatch(b)
+	if m == nil {
+		return ""
+	}
+
+	return strings.ReplaceAll(string(m[1]), "_", "-")
+}
+
+func inject(sourcePath string, sm *StaleMount) error {
+	// Clone the source mount in our mount namespace. The clone
+	// is detached and can be attached in another namespace.
+	treeFd, err := unix.OpenTree(unix.AT_FDCWD, path.Join(sourcePath, sm.Root),
+		unix.OPEN_TREE_CLONE|unix.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("open_tree %s failed: %v", sourcePath, err)
+	}
+	defer unix.Close(treeFd)
+
+	nsFd, err := unix.Open(path.Join("/proc", strconv.Itoa(sm.PID), "ns/mnt"), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open mount namespace: %v", err)
+	}
+	defer unix.Close(nsFd)
+
+	// Mountpoints in /proc/<pid>/mountinfo are relative to the root
+	// of the process, which may differ from the namespace root.
+	rootFd, err := unix.Open(path.Join("/proc", strconv.Itoa(sm.PID), "root"), unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open process root: %v", err)
+	}
+	defer unix.Close(rootFd)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		// Entering a mount namespace changes the state of the calling
+		// thread. The thread is never unlocked, so that the runtime
+		// terminates it once this goroutine exits instead of reusing it.
+		runtime.LockOSThread()
+
+		errCh <- injectInNamespace(treeFd, nsFd, rootFd, sm.Mountpoint)
+	}()
+
+	return <-errCh
+}
+
+func injectInNamespace(treeFd, nsFd, rootFd int, mountpoint string) error {
+	// setns(CLONE_NEWNS) fails for threads that share their
+	// file-system attributes with other threads, which is the
+	// case for all threads of a Go program. Unshare them first.
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return fmt.Errorf("unshare CLONE_FS failed: %v", err)
+	}
+
+	if err := unix.Setns(nsFd, unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("setns failed: %v", err)
+	}
+
+	if err := unix.Fchdir(rootFd); err != nil {
+		return fmt.Errorf("failed to change directory to process root: %v", err)
+	}
+
+	relMountpoint := strings.TrimPrefix(mountpoint, "/")
+	if relMountpoint == "" {
+		relMountpoint = "."
+	}
+
+	if err := unix.Unmount(relMountpoint, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach stale mount: %v", err)
+	}
+
+	if err := unix.MoveMount(treeFd, "", unix.AT_FDCWD, relMountpoint, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("move_mount failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package mountproxy
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Mount proxy API. There are no generated protobuf stubs for this service:
+// messages are plain Go structs encoded as JSON (see codec.go), and the
+// service is described manually below.
+
+type (
+	MountRequest struct {
+		// VolumeID of the volume being mounted. Used for bookkeeping only.
+		VolumeID string `json:"volumeID"`
+
+		// Mountpoint is the path where dummy-fuse should be mounted.
+		Mountpoint string `json:"mountpoint"`
+
+		// Options are mount options passed to dummy-fuse with -o.
+		Options []string `json:"options,omitempty"`
+	}
+
+	MountResponse struct{}
+
+	UnmountRequest struct {
+		// Mountpoint is the path of the dummy-fuse mount to unmount.
+		Mountpoint string `json:"mountpoint"`
+	}
+
+	UnmountResponse struct{}
+
+	ListRequest struct{}
+
+	ListResponse struct {
+		Mounts []Mount `json:"mounts"`
+	}
+
+	// Mount describes a dummy-fuse mount owned by the mount proxy.
+	Mount struct {
+		VolumeID   string    `json:"volumeID"`
+		Mountpoint string    `json:"mountpoint"`
+		MountedAt  time.Time `json:"mountedAt"`
+
+		// State of the mountpoint at the time of the List call.
+		State string `json:"state"`
+	}
+
+	// MountProxyServer is the server API for the mount proxy service.
+	MountProxyServer interface {
+		Mount(context.Context, *MountRequest) (*MountResponse, error)
+		Unmount(context.Context, *UnmountRequest) (*UnmountResponse, error)
+		List(context.Context, *ListRequest) (*ListResponse, error)
+	}
+)
+
+const (
+	serviceName = "mountproxy.v1.MountProxy"
+
+	mountMethod   = "/" + serviceName + "/Mount"
+	unmountMethod = "/" + serviceName + "/Unmount"
+	listMethod    = "/" + serviceName + "/List"
+)
+
+func mountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(MountProxyServer).Mount(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: mountMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MountProxyServer).Mount(ctx, req.(*MountRequest))
+	})
+}
+
+func unmountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnmountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(MountProxyServer).Unmount(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: unmountMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MountProxyServer).Unmount(ctx, req.(*UnmountRequest))
+	})
+}
+
+func listHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(MountProxyServer).List(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: listMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MountProxyServer).List(ctx, req.(*ListRequest))
+	})
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*MountProxyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Mount", Handler: mountHandler},
+		{MethodName: "Unmount", Handler: unmountHandler},
+		{MethodName: "List", Handler: listHandler},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// RegisterMountProxyServer registers srv with GRPC server s.
+func RegisterMountProxyServer(s *grpc.Server, srv MountProxyServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
@@ -0,0 +1,64 @@
+package mountproxy
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client is a mount proxy client.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient creates a new mount proxy client connected to endpoint.
+// Endpoint is a URL of the UNIX domain socket the mount proxy is
+// listening on, e.g. unix:///run/mount-proxy.sock. Connection is
+// established lazily on the first call.
+func NewClient(endpoint string) (*Client, error) {
+	conn, err := grpc.Dial(
+		endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mount proxy at %s: %v", endpoint, err)
+	}
+
+	return &Client{
+		conn: conn,
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) Mount(ctx context.Context, req *MountRequest) (*MountResponse, error) {
+	resp := new(MountResponse)
+	if err := c.conn.Invoke(ctx, mountMethod, req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *Client) Unmount(ctx context.Context, req *UnmountRequest) (*UnmountResponse, error) {
+	resp := new(UnmountResponse)
+	if err := c.conn.Invoke(ctx, unmountMethod, req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *Client) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	resp := new(ListResponse)
+	if err := c.conn.Invoke(ctx, listMethod, req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
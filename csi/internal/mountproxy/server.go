@@ -0,0 +1,124 @@
+package mountproxy
+
+import (
+	"context"
+	goexec "os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/exec"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+	"github.com/gman0/dummy-fuse-csi/csi/internal/mountutils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements MountProxyServer. It runs dummy-fuse processes on behalf
+// of the node plugin, so that the FUSE processes don't share the lifetime
+// of the node plugin container.
+type Server struct {
+	mu     sync.Mutex
+	mounts map[string]*Mount // Keyed by mountpoint.
+}
+
+var _ MountProxyServer = (*Server)(nil)
+
+func NewServer() *Server {
+	return &Server{
+		mounts: make(map[string]*Mount),
+	}
+}
+
+func (srv *Server) Mount(
+	ctx context.Context,
+	req *MountRequest,
+) (*MountResponse, error) {
+	if req.Mountpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "mountpoint missing in request")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.mounts[req.Mountpoint]; ok {
+		if st, err := mountutils.GetState(req.Mountpoint); err == nil && st == mountutils.StMounted {
+			// Already mounted, nothing to do.
+			return &MountResponse{}, nil
+		}
+	}
+
+	args := []string{req.Mountpoint}
+	if len(req.Options) > 0 {
+		args = append([]string{"-o", strings.Join(req.Options, ",")}, args...)
+	}
+
+	if err := exec.RunContext(ctx, goexec.Command("dummy-fuse", args...)); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to mount dummy-fuse in %s: %v", req.Mountpoint, err)
+	}
+
+	srv.mounts[req.Mountpoint] = &Mount{
+		VolumeID:   req.VolumeID,
+		Mountpoint: req.Mountpoint,
+		MountedAt:  time.Now(),
+	}
+
+	log.Infof("Mounted volume %s in %s", req.VolumeID, req.Mountpoint)
+
+	return &MountResponse{}, nil
+}
+
+func (srv *Server) Unmount(
+	ctx context.Context,
+	req *UnmountRequest,
+) (*UnmountResponse, error) {
+	if req.Mountpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "mountpoint missing in request")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := mountutils.UnmountEscalating(ctx, req.Mountpoint, 0); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmount %s: %v", req.Mountpoint, err)
+	}
+
+	delete(srv.mounts, req.Mountpoint)
+
+	log.Infof("Unmounted %s", req.Mountpoint)
+
+	return &UnmountResponse{}, nil
+}
+
+func (srv *Server) List(
+	ctx context.Context,
+	req *ListRequest,
+) (*ListResponse, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	mounts := make([]Mount, 0, len(srv.mounts))
+	for _, m := range srv.mounts {
+		mnt := *m
+
+		st, err := mountutils.GetState(m.Mountpoint)
+		if err != nil {
+			log.Errorf("Failed to probe mountpoint %s: %v", m.Mountpoint, err)
+		}
+		mnt.State = st.String()
+
+		mounts = append(mounts, mnt)
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Mountpoint < mounts[j].Mountpoint
+	})
+
+	return &ListResponse{
+		Mounts: mounts,
+	}, nil
+}
@@ -0,0 +1,209 @@
+package mountutils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+type (
+	// Expectations describe how a healthy mountpoint looks like.
+	// Zero values are not checked.
+	Expectations struct {
+		// FSType is the expected filesystem type, e.g. fuse.dummy-fuse.
+		FSType string
+
+		// ReadWrite means the mountpoint is expected to be mounted read-write.
+		ReadWrite bool
+
+		// BindSource is the path of the mount that the mountpoint is expected
+		// to be a bind mount of.
+		BindSource string
+	}
+
+	// Classification is the result of Classify.
+	Classification struct {
+		Mountpoint string
+		State      State
+
+		// Errno returned when accessing the mountpoint, if any.
+		Errno unix.Errno
+
+		// Mounts stacked on the mountpoint, bottom first.
+		Mounts []*mountinfo.Info
+
+		// Evidence lists observations that led to State, in the order they were made.
+		Evidence []string
+	}
+)
+
+// Classify inspects mountpoint p and classifies its state in more detail than GetState.
+// The classification is based on p's mount table entries, and on the errno returned
+// by stat of p. Like GetState, accessing p is guarded by the probe timeout.
+//
+// States are checked in this order: hung, not mounted, errno-based states (not connected,
+// I/O error, stale), dead bind source, mounted over, wrong filesystem type and read-only.
+// The first one that applies is returned, except that ENOTCONN caused by a dead bind source
+// is reported as StDeadBindSource. Checks that need expect are skipped if it's nil.
+func Classify(p string, expect *Expectations) (*Classification, error) {
+	if expect == nil {
+		expect = &Expectations{}
+	}
+
+	c := &Classification{Mountpoint: p}
+
+	mnts, err := GetStackedMounts(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	c.Mounts = mnts
+
+	for _, m := range mnts {
+		c.addEvidence("mount %d: %s on %s type %s (%s)", m.ID, m.Source, m.Mountpoint, m.FSType, m.Options)
+	}
+
+	var st unix.Stat_t
+	if probeErr := probe(p, func() { err = unix.Stat(p, &st) }); probeErr != nil {
+		c.addEvidence("stat didn't return within %v", probeTimeout)
+		return c.set(StHung), nil
+	}
+
+	if err != nil {
+		if !errors.As(err, &c.Errno) {
+			return nil, fmt.Errorf("failed to stat %s: %v", p, err)
+		}
+		c.addEvidence("stat: %v", c.Errno)
+	}
+
+	if len(mnts) == 0 {
+		if c.Errno != 0 && c.Errno != unix.ENOENT {
+			return nil, fmt.Errorf("failed to stat %s: %v", p, c.Errno)
+		}
+
+		c.addEvidence("no mount table entry")
+		return c.set(StNotMounted), nil
+	}
+
+	switch c.Errno {
+	case 0:
+	case unix.ENOTCONN:
+		if dead, _ := c.checkBindSource(expect.BindSource); dead {
+			return c.set(StDeadBindSource), nil
+		}
+		return c.set(StNotConnected), nil
+	case unix.EIO:
+		return c.set(StIOError), nil
+	case unix.ESTALE:
+		return c.set(StStale), nil
+	default:
+		return c.set(StUnknown), nil
+	}
+
+	if dead, err := c.checkBindSource(expect.BindSource); err != nil {
+		return nil, err
+	} else if dead {
+		return c.set(StDeadBindSource), nil
+	}
+
+	if len(mnts) > 1 {
+		c.addEvidence("%d mounts stacked", len(mnts))
+		return c.set(StMountedOver), nil
+	}
+
+	top := mnts[len(mnts)-1]
+
+	if expect.FSType != "" && top.FSType != expect.FSType {
+		c.addEvidence("expected filesystem type %s", expect.FSType)
+		return c.set(StWrongFSType), nil
+	}
+
+	if expect.ReadWrite && (hasOption(top.Options, "ro") || hasOption(top.VFSOptions, "ro")) {
+		c.addEvidence("expected read-write mount")
+		return c.set(StReadOnly), nil
+	}
+
+	return c.set(StMounted), nil
+}
+
+// checkBindSource reports whether src is not a mount of the same device
+// as the mountpoint, or src itself fails with ENOTCONN.
+func (c *Classification) checkBindSource(src string) (dead bool, err error) {
+	if src == "" {
+		return false, nil
+	}
+
+	srcMnts, err := GetStackedMounts(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	if len(srcMnts) == 0 {
+		c.addEvidence("bind source %s is not mounted", src)
+		return true, nil
+	}
+
+	top := c.Mounts[len(c.Mounts)-1]
+	srcTop := srcMnts[len(srcMnts)-1]
+
+	if srcTop.Major != top.Major || srcTop.Minor != top.Minor {
+		c.addEvidence("bind source %s is device %d:%d, expected %d:%d",
+			src, srcTop.Major, srcTop.Minor, top.Major, top.Minor)
+		return true, nil
+	}
+
+	var (
+		st     unix.Stat_t
+		srcErr error
+	)
+
+	if probeErr := probe(src, func() { srcErr = unix.Stat(src, &st) }); probeErr != nil {
+		// The source is hung, not dead.
+		c.addEvidence("stat of bind source %s didn't return within %v", src, probeTimeout)
+		return false, nil
+	}
+
+	if errors.Is(srcErr, unix.ENOTCONN) {
+		c.addEvidence("bind source %s: %v", src, srcErr)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (c *Classification) set(st State) *Classification {
+	c.State = st
+	return c
+}
+
+func (c *Classification) addEvidence(format string, args ...interface{}) {
+	c.Evidence = append(c.Evidence, fmt.Sprintf(format, args...))
+}
+
+// String returns the state along with the evidence.
+func (c *Classification) String() string {
+	return fmt.Sprintf("%s is in %s state (%s)", c.Mountpoint, c.State, strings.Join(c.Evidence, "; "))
+}
+
+// IsBroken reports whether the mountpoint is mounted, but not usable
+// and may be fixed by remounting.
+func (c *Classification) IsBroken() bool {
+	switch c.State {
+	case StNotConnected, StIOError, StStale, StDeadBindSource:
+		return true
+	default:
+		return false
+	}
+}
+
+func hasOption(opts, opt string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return true
+		}
+	}
+
+	return false
+}
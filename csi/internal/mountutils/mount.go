@@ -2,17 +2,88 @@ package mountutils
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	goexec "os/exec"
 
 	"github.com/gman0/dummy-fuse-csi/csi/internal/exec"
 )
 
-func Unmount(mountpoint string, extraArgs ...string) error {
-	out, err := exec.CombinedOutput(goexec.Command("umount", append(extraArgs, mountpoint)...))
+type (
+	// Backend is the way mount operations are performed.
+	Backend string
+
+	// UnmountFlags modify the behavior of Unmount.
+	UnmountFlags int
+)
+
+const (
+	// BackendNative uses mount(2), umount2(2) and mount_setattr(2) syscalls directly.
+	BackendNative Backend = "native"
+	// BackendExec runs mount(8) and umount(8) binaries.
+	BackendExec Backend = "exec"
+)
+
+const (
+	// UnmountRecursive unmounts also all mounts nested in the mountpoint.
+	UnmountRecursive UnmountFlags = 1 << iota
+	// UnmountDetach lazily detaches the mountpoint.
+	UnmountDetach
+)
+
+var backend = BackendNative
+
+// ParseBackend returns the Backend named s.
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case BackendNative, BackendExec:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown mount backend %q, expected one of %s, %s", s, BackendNative, BackendExec)
+	}
+}
+
+// SetBackend sets the backend used for mount operations. Must be called
+// before any mount operations are performed.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// CurrentBackend returns the backend used for mount operations.
+func CurrentBackend() Backend {
+	return backend
+}
+
+// Unmount unmounts mountpoint. Unmounting a path that is not mounted,
+// or doesn't exist, is not an error.
+//
+// If ctx is done before unmounting finishes, the returned error wraps ctx.Err().
+// With the exec backend, umount is killed. With the native backend, the umount2
+// syscall can't be interrupted and is left running, and errors are of type
+// *MountError.
+func Unmount(ctx context.Context, mountpoint string, flags UnmountFlags) error {
+	if backend == BackendNative {
+		return unmountNative(ctx, mountpoint, flags)
+	}
+
+	return unmountExec(ctx, mountpoint, flags)
+}
+
+func unmountExec(ctx context.Context, mountpoint string, flags UnmountFlags) error {
+	var args []string
+	if flags&UnmountRecursive != 0 {
+		args = append(args, "--recursive")
+	}
+	if flags&UnmountDetach != 0 {
+		args = append(args, "--lazy")
+	}
+
+	out, err := exec.CombinedOutputContext(ctx, goexec.Command("umount", append(args, mountpoint)...))
 	if err != nil {
 		// There are no well-defined exit codes for cases of "not mounted"
-		// and "doesn't exist". We need to check the output.
-		if bytes.HasSuffix(out, []byte(": not mounted")) ||
+		// and "doesn't exist". We need to check the output. Newer util-linux
+		// versions end the message with a period.
+		if bytes.Contains(out, []byte(": not mounted")) ||
 			bytes.Contains(out, []byte("No such file or directory")) {
 			return nil
 		}
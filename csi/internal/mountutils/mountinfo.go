@@ -0,0 +1,124 @@
+package mountutils
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+// GetMountInfo returns the mount table entry of mountpoint p. If there are
+// multiple mounts stacked on p, the topmost one is returned. If p is not
+// a mountpoint, nil is returned.
+//
+// Unlike GetState, GetMountInfo only reads /proc/self/mountinfo and doesn't
+// access p itself, so it's safe to call on broken mounts.
+func GetMountInfo(p string) (*mountinfo.Info, error) {
+	mnts, err := GetStackedMounts(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mnts) == 0 {
+		return nil, nil
+	}
+
+	return mnts[len(mnts)-1], nil
+}
+
+// GetStackedMounts returns all mount table entries of mountpoint p, bottom first.
+// If p is not a mountpoint, nil is returned. Like GetMountInfo, it doesn't access p.
+func GetStackedMounts(p string) ([]*mountinfo.Info, error) {
+	mnts, err := mountinfo.GetMounts(func(m *mountinfo.Info) (skip, stop bool) {
+		return m.Mountpoint != p, false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orderStackedMounts(mnts), nil
+}
+
+// orderStackedMounts orders mounts on the same mountpoint bottom first.
+// A mount stacked on top of another one has the other one as its parent.
+func orderStackedMounts(mnts []*mountinfo.Info) []*mountinfo.Info {
+	if len(mnts) < 2 {
+		return mnts
+	}
+
+	// Order by mount ID first. IDs are usually increasing, and this
+	// is the fallback if the parent chain cannot be followed.
+	sort.Slice(mnts, func(i, j int) bool { return mnts[i].ID < mnts[j].ID })
+
+	byParent := make(map[int]*mountinfo.Info, len(mnts))
+	ids := make(map[int]struct{}, len(mnts))
+	for _, m := range mnts {
+		byParent[m.Parent] = m
+		ids[m.ID] = struct{}{}
+	}
+
+	// The bottom mount is the one whose parent is not on this mountpoint.
+	var bottom *mountinfo.Info
+	for _, m := range mnts {
+		if _, ok := ids[m.Parent]; !ok {
+			if bottom != nil {
+				// More than one candidate, the chain is ambiguous.
+				return mnts
+			}
+			bottom = m
+		}
+	}
+
+	if bottom == nil {
+		return mnts
+	}
+
+	ordered := make([]*mountinfo.Info, 0, len(mnts))
+	for m := bottom; m != nil && len(ordered) < len(mnts); m = byParent[m.ID] {
+		ordered = append(ordered, m)
+	}
+
+	if len(ordered) != len(mnts) {
+		return mnts
+	}
+
+	return ordered
+}
+
+// GetBindMounts returns mount table entries that share the source of mountpoint p,
+// i.e. mounts of the same device whose root is the root of p's mount, or is
+// nested in it. Mounts in p itself are not included. If p is not a mountpoint,
+// nil is returned.
+//
+// Like GetMountInfo, GetBindMounts doesn't access p itself.
+func GetBindMounts(p string) ([]*mountinfo.Info, error) {
+	mnts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var src *mountinfo.Info
+	for _, m := range mnts {
+		if m.Mountpoint == p {
+			// Keep the topmost one.
+			src = m
+		}
+	}
+
+	if src == nil {
+		return nil, nil
+	}
+
+	var binds []*mountinfo.Info
+	for _, m := range mnts {
+		if m.Mountpoint == p || m.Major != src.Major || m.Minor != src.Minor {
+			continue
+		}
+
+		if src.Root == "/" || m.Root == src.Root || strings.HasPrefix(m.Root, src.Root+"/") {
+			binds = append(binds, m)
+		}
+	}
+
+	return binds, nil
+}
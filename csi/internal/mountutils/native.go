@@ -0,0 +1,207 @@
+package mountutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+// MountError is returned by native mount operations.
+type MountError struct {
+	// Op is the failed syscall, e.g. mount, umount2 or mount_setattr.
+	Op     string
+	Source string
+	Target string
+	Flags  uintptr
+	Err    error
+}
+
+func (e *MountError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s %s on %s (flags %#x): %v", e.Op, e.Source, e.Target, e.Flags, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s (flags %#x): %v", e.Op, e.Target, e.Flags, e.Err)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
+// Mount syscalls may block on unresponsive FUSE mounts just like stat does,
+// e.g. umount2 of a mount whose daemon is stopped, and they can't be
+// interrupted. Native mount operations run their syscall in a watchdog
+// goroutine, like probes do, and stop waiting for it once ctx is done.
+// The syscall may still complete later, leaving the mount table in either
+// state, which is fine as callers re-check the mount table before retrying.
+//
+// Unlike probes, concurrent syscalls on the same path are not refused:
+// escalating unmount strategies must be able to retry a path (e.g. with
+// MNT_DETACH, which doesn't wait for the filesystem) while a previous
+// attempt is still stuck.
+
+// syscallWithContext runs f in a watchdog goroutine. If ctx is done before
+// f returns, the returned *MountError wraps ctx.Err().
+func syscallWithContext(ctx context.Context, e *MountError, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		e.Err = err
+		return e
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- f()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			return nil
+		}
+		e.Err = err
+		return e
+	case <-ctx.Done():
+		log.Warningf("%s %s didn't return before %v, giving up waiting", e.Op, e.Target, ctx.Err())
+
+		go func() {
+			if err := <-errCh; err != nil {
+				log.Warningf("Stuck %s %s eventually failed: %v", e.Op, e.Target, err)
+			} else {
+				log.Warningf("Stuck %s %s eventually succeeded", e.Op, e.Target)
+			}
+		}()
+
+		// e is not shared with the goroutine, it's safe to modify.
+		e.Err = ctx.Err()
+		return e
+	}
+}
+
+// BindMount bind-mounts from into to. If recursive is set, mounts nested
+// in from are bind-mounted too.
+func BindMount(ctx context.Context, from, to string, recursive bool) error {
+	flags := uintptr(unix.MS_BIND)
+	if recursive {
+		flags |= unix.MS_REC
+	}
+
+	return syscallWithContext(ctx, &MountError{Op: "mount", Source: from, Target: to, Flags: flags}, func() error {
+		return unix.Mount(from, to, "", flags, "")
+	})
+}
+
+// MakeSlave recursively changes propagation type of mountpoint to slave.
+func MakeSlave(ctx context.Context, mountpoint string) error {
+	const flags = unix.MS_SLAVE | unix.MS_REC
+
+	return syscallWithContext(ctx, &MountError{Op: "mount", Target: mountpoint, Flags: flags}, func() error {
+		return unix.Mount("", mountpoint, "", flags, "")
+	})
+}
+
+// RemountBind sets per-mountpoint flags of a bind mount in mountpoint to msFlags.
+// Flags that are not set in msFlags are cleared. Only the topmost mount is changed.
+func RemountBind(ctx context.Context, mountpoint string, msFlags uintptr) error {
+	flags := unix.MS_REMOUNT | unix.MS_BIND | msFlags
+
+	return syscallWithContext(ctx, &MountError{Op: "mount", Target: mountpoint, Flags: flags}, func() error {
+		return unix.Mount("", mountpoint, "", flags, "")
+	})
+}
+
+// SetMountAttr changes mount attributes of mountpoint with mount_setattr(2).
+// If recursive is set, mounts nested in mountpoint are changed too. Returns
+// an error wrapping unix.ENOSYS on kernels older than 5.12.
+func SetMountAttr(ctx context.Context, mountpoint string, attr *unix.MountAttr, recursive bool) error {
+	var flags uint
+	if recursive {
+		flags |= unix.AT_RECURSIVE
+	}
+
+	return syscallWithContext(ctx, &MountError{Op: "mount_setattr", Target: mountpoint, Flags: uintptr(flags)}, func() error {
+		return unix.MountSetattr(unix.AT_FDCWD, mountpoint, flags, attr)
+	})
+}
+
+// MountFlags returns MS_* flags corresponding to per-mountpoint options of mnt.
+func MountFlags(mnt *mountinfo.Info) uintptr {
+	optFlags := map[string]uintptr{
+		"ro":          unix.MS_RDONLY,
+		"nosuid":      unix.MS_NOSUID,
+		"nodev":       unix.MS_NODEV,
+		"noexec":      unix.MS_NOEXEC,
+		"noatime":     unix.MS_NOATIME,
+		"nodiratime":  unix.MS_NODIRATIME,
+		"relatime":    unix.MS_RELATIME,
+		"strictatime": unix.MS_STRICTATIME,
+	}
+
+	var flags uintptr
+	for _, opt := range strings.Split(mnt.Options, ",") {
+		flags |= optFlags[opt]
+	}
+
+	return flags
+}
+
+func unmountNative(ctx context.Context, mountpoint string, flags UnmountFlags) error {
+	if flags&UnmountRecursive == 0 || flags&UnmountDetach != 0 {
+		// Lazy unmount detaches the whole subtree.
+		return unmount2(ctx, mountpoint, flags)
+	}
+
+	// Unmount nested mounts first, the most recent ones first.
+	mnts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(mountpoint))
+	if err != nil {
+		return fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	sort.Slice(mnts, func(i, j int) bool {
+		if len(mnts[i].Mountpoint) != len(mnts[j].Mountpoint) {
+			return len(mnts[i].Mountpoint) > len(mnts[j].Mountpoint)
+		}
+		return mnts[i].ID > mnts[j].ID
+	})
+
+	for _, m := range mnts {
+		if err := unmount2(ctx, m.Mountpoint, flags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unmount2(ctx context.Context, mountpoint string, flags UnmountFlags) error {
+	var umountFlags int
+	if flags&UnmountDetach != 0 {
+		umountFlags |= unix.MNT_DETACH
+	}
+
+	e := &MountError{Op: "umount2", Target: mountpoint, Flags: uintptr(umountFlags)}
+
+	err := syscallWithContext(ctx, e, func() error {
+		return unix.Unmount(mountpoint, umountFlags)
+	})
+	if err == nil || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+
+	if errors.Is(err, unix.EINVAL) {
+		// EINVAL is returned also for invalid flags, make sure
+		// mountpoint is really not mounted.
+		if mnt, infoErr := GetMountInfo(mountpoint); infoErr == nil && mnt == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+package mountutils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+// Syscalls on a FUSE mount whose daemon is stopped (but not dead) block until
+// the daemon resumes, and can't be interrupted. Probes run such syscalls
+// in a watchdog goroutine, and give up waiting after the probe timeout.
+//
+// A goroutine stuck in a syscall can't be cancelled. To avoid piling up stuck
+// goroutines, there is at most one probe in flight per path: while a previous
+// probe of the same path hasn't returned, new probes fail immediately.
+
+const DefaultProbeTimeout = 5 * time.Second
+
+var ErrProbeTimeout = errors.New("mountpoint probe timed out")
+
+var (
+	probeTimeout = DefaultProbeTimeout
+
+	probesMtx sync.Mutex
+	// Paths with a probe in flight.
+	probes = make(map[string]struct{})
+)
+
+// SetProbeTimeout sets the timeout of mountpoint probes. Must be called
+// before any probes are run.
+func SetProbeTimeout(timeout time.Duration) {
+	probeTimeout = timeout
+}
+
+// probe runs f in a watchdog goroutine. If f doesn't return within the probe
+// timeout, or a previous probe of p is still running, ErrProbeTimeout is returned.
+// In that case the caller must not access any values set by f.
+func probe(p string, f func()) error {
+	probesMtx.Lock()
+	if _, ok := probes[p]; ok {
+		probesMtx.Unlock()
+		return ErrProbeTimeout
+	}
+	probes[p] = struct{}{}
+	probesMtx.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		f()
+		close(done)
+
+		probesMtx.Lock()
+		delete(probes, p)
+		probesMtx.Unlock()
+	}()
+
+	t := time.NewTimer(probeTimeout)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+		log.Warningf("Probe of mountpoint %s timed out after %v", p, probeTimeout)
+		return ErrProbeTimeout
+	}
+}
+
+// Statfs is like unix.Statfs, but returns ErrProbeTimeout if p doesn't respond
+// within the probe timeout.
+func Statfs(p string, buf *unix.Statfs_t) error {
+	var (
+		st  unix.Statfs_t
+		err error
+	)
+
+	if probeErr := probe(p, func() { err = unix.Statfs(p, &st) }); probeErr != nil {
+		return probeErr
+	}
+
+	*buf = st
+
+	return err
+}
@@ -13,6 +13,27 @@ const (
 	StNotMounted
 	StMounted
 	StCorrupted
+	// StHung means the mountpoint didn't respond to a probe in time,
+	// e.g. its FUSE daemon is stopped.
+	StHung
+
+	// Fine-grained states reported by Classify.
+
+	// StNotConnected means the mountpoint fails with ENOTCONN, i.e. its FUSE daemon exited.
+	StNotConnected
+	// StIOError means the mountpoint fails with EIO.
+	StIOError
+	// StStale means the mountpoint fails with ESTALE.
+	StStale
+	// StDeadBindSource means the mountpoint is a bind mount whose source
+	// mount is gone or broken.
+	StDeadBindSource
+	// StWrongFSType means the mountpoint has an unexpected filesystem type.
+	StWrongFSType
+	// StReadOnly means the mountpoint is read-only, but read-write was expected.
+	StReadOnly
+	// StMountedOver means there are multiple mounts stacked on the mountpoint.
+	StMountedOver
 )
 
 var (
@@ -25,10 +46,34 @@ func (s State) String() string {
 		"NOT_MOUNTED",
 		"MOUNTED",
 		"CORRUPTED",
+		"HUNG",
+		"NOT_CONNECTED",
+		"IO_ERROR",
+		"STALE",
+		"DEAD_BIND_SOURCE",
+		"WRONG_FS_TYPE",
+		"READ_ONLY",
+		"MOUNTED_OVER",
 	}[int(s)]
 }
 
+// GetState returns the state of mountpoint p. Accessing p is done in a watchdog
+// goroutine, and if it doesn't finish within the probe timeout (see SetProbeTimeout),
+// StHung is returned. GetState never blocks longer than the probe timeout.
 func GetState(p string) (State, error) {
+	var (
+		st  State
+		err error
+	)
+
+	if probeErr := probe(p, func() { st, err = getState(p) }); probeErr != nil {
+		return StHung, nil
+	}
+
+	return st, err
+}
+
+func getState(p string) (State, error) {
 	isNotMnt, err := mount.IsNotMountPoint(dummyMounter, p)
 	if err != nil {
 		if mount.IsCorruptedMnt(err) {
@@ -0,0 +1,201 @@
+package mountutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+type (
+	// UnmountStrategy is a way of unmounting a mountpoint.
+	UnmountStrategy int
+)
+
+const (
+	// UnmountNormal runs plain umount.
+	UnmountNormal UnmountStrategy = iota
+	// UnmountFuseAbort aborts the mount's FUSE connection through fusectl,
+	// failing all pending and future requests with ENOTCONN, and then runs
+	// plain umount. Applies only to FUSE mounts.
+	UnmountFuseAbort
+	// UnmountLazy detaches the mountpoint with a lazy unmount. The filesystem
+	// is cleaned up once it's no longer busy.
+	UnmountLazy
+)
+
+// DefaultUnmountStrategies are tried in this order by UnmountEscalating.
+var DefaultUnmountStrategies = []UnmountStrategy{
+	UnmountNormal,
+	UnmountFuseAbort,
+	UnmountLazy,
+}
+
+// BindUnmountStrategies are suitable for bind mounts of FUSE mounts. Aborting
+// the FUSE connection of a bind mount would break all other mounts that share it.
+var BindUnmountStrategies = []UnmountStrategy{
+	UnmountNormal,
+	UnmountLazy,
+}
+
+// FuseConnectionsDir is the mountpoint of fusectl filesystem.
+const FuseConnectionsDir = "/sys/fs/fuse/connections"
+
+func (s UnmountStrategy) String() string {
+	switch s {
+	case UnmountNormal:
+		return "normal"
+	case UnmountFuseAbort:
+		return "fuse-abort"
+	case UnmountLazy:
+		return "lazy"
+	default:
+		return fmt.Sprintf("UnmountStrategy(%d)", int(s))
+	}
+}
+
+// UnmountEscalating unmounts the topmost mount in mountpoint, trying
+// DefaultUnmountStrategies in order until one of them succeeds.
+// See UnmountWithStrategies.
+func UnmountEscalating(ctx context.Context, mountpoint string, flags UnmountFlags) error {
+	return UnmountWithStrategies(ctx, mountpoint, DefaultUnmountStrategies, flags)
+}
+
+// UnmountWithStrategies unmounts the topmost mount in mountpoint, trying strategies
+// in order until one of them succeeds. A strategy succeeded if the mount is no longer
+// in the mount table. Each attempt is limited by the probe timeout, because umount
+// may hang on unresponsive FUSE mounts. flags are passed to Unmount.
+//
+// Unmounting a path that is not mounted is not an error. The mountpoint itself is
+// never accessed, only the mount table and fusectl.
+func UnmountWithStrategies(
+	ctx context.Context,
+	mountpoint string,
+	strategies []UnmountStrategy,
+	flags UnmountFlags,
+) error {
+	mnt, err := GetMountInfo(mountpoint)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	if mnt == nil {
+		return nil
+	}
+
+	var errs []error
+
+	for _, s := range strategies {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		err := unmountWithStrategy(ctx, s, mnt, flags)
+		if err == nil {
+			var mounted bool
+			if mounted, err = isMountIDMounted(mnt.ID); err == nil && !mounted {
+				if s != UnmountNormal {
+					log.Infof("Unmounted %s with %s strategy", mountpoint, s)
+				}
+
+				return nil
+			}
+
+			if err == nil {
+				err = errors.New("still mounted")
+			}
+		}
+
+		log.Warningf("Failed to unmount %s with %s strategy: %v", mountpoint, s, err)
+		errs = append(errs, fmt.Errorf("%s: %w", s, err))
+	}
+
+	return fmt.Errorf("failed to unmount %s: %w", mountpoint, errors.Join(errs...))
+}
+
+func unmountWithStrategy(ctx context.Context, s UnmountStrategy, mnt *mountinfo.Info, flags UnmountFlags) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	switch s {
+	case UnmountNormal:
+		return Unmount(ctx, mnt.Mountpoint, flags)
+	case UnmountFuseAbort:
+		if err := AbortFuseConnection(mnt); err != nil {
+			return err
+		}
+		return Unmount(ctx, mnt.Mountpoint, flags)
+	case UnmountLazy:
+		return Unmount(ctx, mnt.Mountpoint, flags|UnmountDetach)
+	default:
+		return fmt.Errorf("unknown unmount strategy %s", s)
+	}
+}
+
+// FuseConnectionID returns the ID of mnt's FUSE connection, as listed in
+// FuseConnectionsDir. The ID is the kernel-internal device number
+// of the FUSE superblock.
+func FuseConnectionID(mnt *mountinfo.Info) (uint64, error) {
+	if !isFuseFSType(mnt.FSType) {
+		return 0, fmt.Errorf("%s is not a FUSE mount, got filesystem type %s", mnt.Mountpoint, mnt.FSType)
+	}
+
+	// Kernel's MKDEV(major, minor), which is different from the
+	// userspace-visible encoding used by unix.Mkdev.
+	return uint64(mnt.Major)<<20 | uint64(mnt.Minor), nil
+}
+
+// AbortFuseConnection aborts the FUSE connection of mount mnt. Requires
+// fusectl to be mounted in FuseConnectionsDir.
+func AbortFuseConnection(mnt *mountinfo.Info) error {
+	connID, err := FuseConnectionID(mnt)
+	if err != nil {
+		return err
+	}
+
+	abortPath := path.Join(FuseConnectionsDir, strconv.FormatUint(connID, 10), "abort")
+
+	f, err := os.OpenFile(abortPath, os.O_WRONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("FUSE connection %d not found, is fusectl mounted in %s? %w",
+				connID, FuseConnectionsDir, err)
+		}
+		return fmt.Errorf("failed to open %s: %v", abortPath, err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString("1"); err != nil {
+		return fmt.Errorf("failed to write %s: %v", abortPath, err)
+	}
+
+	log.Infof("Aborted FUSE connection %d of %s", connID, mnt.Mountpoint)
+
+	return nil
+}
+
+func isFuseFSType(fsType string) bool {
+	return fsType == "fuse" || fsType == "fuseblk" || strings.HasPrefix(fsType, "fuse.")
+}
+
+func isMountIDMounted(id int) (bool, error) {
+	mnts, err := mountinfo.GetMounts(func(m *mountinfo.Info) (skip, stop bool) {
+		if m.ID == id {
+			return false, true
+		}
+		return true, false
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	return len(mnts) > 0, nil
+}
@@ -0,0 +1,231 @@
+package mountutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+)
+
+// The kernel signals changes of the mount table by raising POLLPRI (and POLLERR)
+// on open /proc/self/mountinfo files. The Watcher waits for these with epoll,
+// re-reads the mount table and compares it with the previous one.
+//
+// Note that a FUSE daemon exiting doesn't change the mount table by itself.
+// Its mount stays in place (and fails with ENOTCONN) until it's unmounted,
+// e.g. by fusermount3 when the daemon runs with auto_unmount.
+
+type (
+	// EventType is the kind of a mount table change.
+	EventType int
+
+	// Event describes a change of the topmost mount in a mountpoint.
+	Event struct {
+		Type       EventType
+		Mountpoint string
+
+		// Old is the mount before the change, nil for EventMounted.
+		Old *mountinfo.Info
+		// New is the mount after the change, nil for EventUnmounted.
+		New *mountinfo.Info
+	}
+
+	// Watcher watches the mount table and sends events for mountpoints
+	// accepted by its filter to subscribers.
+	Watcher struct {
+		filter func(mountpoint string) bool
+
+		mu      sync.Mutex
+		subs    map[int]chan Event
+		nextSub int
+	}
+)
+
+const (
+	EventMounted EventType = iota
+	EventUnmounted
+	EventOptionsChanged
+)
+
+const mountinfoPath = "/proc/self/mountinfo"
+
+// How often Run checks whether its context is done.
+const watcherPollTimeoutMs = 1000
+
+func (t EventType) String() string {
+	switch t {
+	case EventMounted:
+		return "mounted"
+	case EventUnmounted:
+		return "unmounted"
+	case EventOptionsChanged:
+		return "options-changed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s %s", e.Mountpoint, e.Type)
+}
+
+// NewWatcher creates a new mount table watcher. Only changes of mountpoints
+// for which filter returns true are sent to subscribers. filter is called
+// from the watcher's goroutine each time the mount table changes.
+func NewWatcher(filter func(mountpoint string) bool) *Watcher {
+	return &Watcher{
+		filter: filter,
+		subs:   make(map[int]chan Event),
+	}
+}
+
+// Subscribe returns a channel that receives mount events. Events are dropped
+// if the channel's buffer of size bufSize is full, so that a slow subscriber
+// never blocks the watcher. cancel unsubscribes and closes the channel.
+func (w *Watcher) Subscribe(bufSize int) (events <-chan Event, cancel func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextSub
+	w.nextSub++
+
+	ch := make(chan Event, bufSize)
+	w.subs[id] = ch
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if _, ok := w.subs[id]; ok {
+			delete(w.subs, id)
+			close(ch)
+		}
+	}
+}
+
+// Run watches the mount table until ctx is done.
+func (w *Watcher) Run(ctx context.Context) error {
+	// Not using os.Open, as that would register the fd also with Go's netpoller.
+	// Each poll of the file consumes the pending change notification, and the
+	// runtime would then take it away from us.
+	fd, err := unix.Open(mountinfoPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", mountinfoPath, err)
+	}
+	defer unix.Close(fd)
+
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to create epoll instance: %v", err)
+	}
+	defer unix.Close(epfd)
+
+	ev := unix.EpollEvent{
+		Events: unix.EPOLLPRI | unix.EPOLLERR,
+		Fd:     int32(fd),
+	}
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		return fmt.Errorf("failed to add %s to epoll: %v", mountinfoPath, err)
+	}
+
+	prev, err := topMounts()
+	if err != nil {
+		return err
+	}
+
+	events := make([]unix.EpollEvent, 1)
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		n, err := unix.EpollWait(epfd, events, watcherPollTimeoutMs)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return fmt.Errorf("failed to wait for mount table changes: %v", err)
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		curr, err := topMounts()
+		if err != nil {
+			log.Errorf("Mount watcher: %v", err)
+			continue
+		}
+
+		for _, e := range diffMounts(prev, curr) {
+			if w.filter == nil || w.filter(e.Mountpoint) {
+				w.send(e)
+			}
+		}
+
+		prev = curr
+	}
+}
+
+func (w *Watcher) send(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, ch := range w.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Warningf("Mount watcher: subscriber is not keeping up, dropping event %s", &e)
+		}
+	}
+}
+
+// topMounts returns the topmost mount of each mountpoint.
+func topMounts() (map[string]*mountinfo.Info, error) {
+	mnts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+
+	top := make(map[string]*mountinfo.Info, len(mnts))
+	for _, m := range mnts {
+		// Later entries are stacked on top of earlier ones.
+		top[m.Mountpoint] = m
+	}
+
+	return top, nil
+}
+
+func diffMounts(prev, curr map[string]*mountinfo.Info) []Event {
+	var events []Event
+
+	for mp, old := range prev {
+		m, ok := curr[mp]
+		switch {
+		case !ok:
+			events = append(events, Event{Type: EventUnmounted, Mountpoint: mp, Old: old})
+		case m.ID != old.ID:
+			// Replaced by a different mount since the last check.
+			events = append(events,
+				Event{Type: EventUnmounted, Mountpoint: mp, Old: old},
+				Event{Type: EventMounted, Mountpoint: mp, New: m},
+			)
+		case m.Options != old.Options || m.VFSOptions != old.VFSOptions:
+			events = append(events, Event{Type: EventOptionsChanged, Mountpoint: mp, Old: old, New: m})
+		}
+	}
+
+	for mp, m := range curr {
+		if _, ok := prev[mp]; !ok {
+			events = append(events, Event{Type: EventMounted, Mountpoint: mp, New: m})
+		}
+	}
+
+	return events
+}
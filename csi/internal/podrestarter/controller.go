@@ -0,0 +1,380 @@
+package podrestarter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gman0/dummy-fuse-csi/csi/internal/log"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// The pod restarter watches for Events that report unhealthy dummy-fuse
+// volumes (either on Pods or on PVCs), and restarts the affected Pods.
+// Restarting a Pod makes kubelet unpublish and publish its volumes again,
+// which restores its mounts.
+
+type (
+	// Opts holds init-time pod restarter configuration.
+	Opts struct {
+		// DriverName is the name of the CSI driver whose volumes are watched.
+		DriverName string
+
+		// NamespaceLabel is the label key that must be set to "true"
+		// on a namespace for its Pods to be restarted.
+		NamespaceLabel string
+
+		// Evict makes the controller evict Pods instead of deleting them.
+		// Eviction respects PodDisruptionBudgets.
+		Evict bool
+
+		// RestartQPS and RestartBurst limit the rate of Pod restarts.
+		RestartQPS   float64
+		RestartBurst int
+
+		// Resync is the informers' resync period.
+		Resync time.Duration
+	}
+
+	// podRef identifies a Pod to be restarted.
+	podRef struct {
+		namespace string
+		name      string
+
+		// UID of the Pod the health event was reported for. If empty,
+		// the Pod was found through a PVC event.
+		uid types.UID
+	}
+
+	Controller struct {
+		*Opts
+
+		client kubernetes.Interface
+
+		factory   informers.SharedInformerFactory
+		podLister corelisters.PodLister
+		pvcLister corelisters.PersistentVolumeClaimLister
+		pvLister  corelisters.PersistentVolumeLister
+		nsLister  corelisters.NamespaceLister
+		synced    []cache.InformerSynced
+
+		queue   workqueue.RateLimitingInterface
+		limiter *rate.Limiter
+
+		// Events older than this are ignored.
+		startTime time.Time
+	}
+)
+
+const (
+	// Reason of Events reporting abnormal volume condition.
+	volumeConditionAbnormalReason = "VolumeConditionAbnormal"
+)
+
+var (
+	// Messages that indicate a corrupted FUSE mount. Matched case-insensitively.
+	corruptedMountMessages = []string{
+		"transport endpoint is not connected", // ENOTCONN, glibc
+		"socket not connected",                // ENOTCONN, musl
+	}
+)
+
+// New creates a new pod restarter controller.
+func New(client kubernetes.Interface, opts *Opts) *Controller {
+	factory := informers.NewSharedInformerFactory(client, opts.Resync)
+
+	var (
+		eventInformer = factory.Core().V1().Events()
+		podInformer   = factory.Core().V1().Pods()
+		pvcInformer   = factory.Core().V1().PersistentVolumeClaims()
+		pvInformer    = factory.Core().V1().PersistentVolumes()
+		nsInformer    = factory.Core().V1().Namespaces()
+	)
+
+	c := &Controller{
+		Opts:      opts,
+		client:    client,
+		factory:   factory,
+		podLister: podInformer.Lister(),
+		pvcLister: pvcInformer.Lister(),
+		pvLister:  pvInformer.Lister(),
+		nsLister:  nsInformer.Lister(),
+		synced: []cache.InformerSynced{
+			eventInformer.Informer().HasSynced,
+			podInformer.Informer().HasSynced,
+			pvcInformer.Informer().HasSynced,
+			pvInformer.Informer().HasSynced,
+			nsInformer.Informer().HasSynced,
+		},
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		limiter:   rate.NewLimiter(rate.Limit(opts.RestartQPS), opts.RestartBurst),
+		startTime: time.Now(),
+	}
+
+	eventInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.onEvent,
+		UpdateFunc: func(_, newObj interface{}) {
+			c.onEvent(newObj)
+		},
+	})
+
+	return c
+}
+
+// Run starts the informers and workers, and blocks until ctx is done.
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+
+	log.Infof("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to sync informer caches")
+	}
+
+	log.Infof("Starting %d workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func isVolumeHealthEvent(ev *corev1.Event) bool {
+	if ev.Type != corev1.EventTypeWarning {
+		return false
+	}
+
+	if ev.Reason == volumeConditionAbnormalReason {
+		return true
+	}
+
+	msg := strings.ToLower(ev.Message)
+	for _, m := range corruptedMountMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func eventTime(ev *corev1.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+
+	if !ev.EventTime.IsZero() {
+		return ev.EventTime.Time
+	}
+
+	return ev.CreationTimestamp.Time
+}
+
+func (c *Controller) onEvent(obj interface{}) {
+	ev, ok := obj.(*corev1.Event)
+	if !ok || !isVolumeHealthEvent(ev) {
+		return
+	}
+
+	if eventTime(ev).Before(c.startTime) {
+		return
+	}
+
+	involved := &ev.InvolvedObject
+
+	switch involved.Kind {
+	case "Pod":
+		c.queue.Add(podRef{
+			namespace: involved.Namespace,
+			name:      involved.Name,
+			uid:       involved.UID,
+		})
+	case "PersistentVolumeClaim":
+		pods, err := c.podsUsingClaim(involved.Namespace, involved.Name)
+		if err != nil {
+			log.Errorf("Failed to list Pods using PVC %s/%s: %v", involved.Namespace, involved.Name, err)
+			return
+		}
+
+		for _, pod := range pods {
+			c.queue.Add(podRef{
+				namespace: pod.Namespace,
+				name:      pod.Name,
+			})
+		}
+	}
+}
+
+func (c *Controller) podsUsingClaim(namespace, claimName string) ([]*corev1.Pod, error) {
+	pods, err := c.podLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*corev1.Pod
+	for _, pod := range pods {
+		for i := range pod.Spec.Volumes {
+			pvcSrc := pod.Spec.Volumes[i].PersistentVolumeClaim
+			if pvcSrc != nil && pvcSrc.ClaimName == claimName {
+				res = append(res, pod)
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	ref := item.(podRef)
+
+	if err := c.syncPod(ctx, ref); err != nil {
+		log.Errorf("Failed to restart Pod %s/%s: %v", ref.namespace, ref.name, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+
+	c.queue.Forget(item)
+	return true
+}
+
+// syncPod restarts Pod ref if it's eligible for restart.
+func (c *Controller) syncPod(ctx context.Context, ref podRef) error {
+	pod, err := c.podLister.Pods(ref.namespace).Get(ref.name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if ref.uid != "" && pod.UID != ref.uid {
+		// The event was reported for a previous instance of this Pod.
+		return nil
+	}
+
+	if pod.DeletionTimestamp != nil {
+		return nil
+	}
+
+	optedIn, err := c.namespaceOptedIn(pod.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if !optedIn {
+		log.Debugf("Skipping Pod %s/%s: namespace not opted in", pod.Namespace, pod.Name)
+		return nil
+	}
+
+	if !c.usesDriver(pod) {
+		log.Debugf("Skipping Pod %s/%s: no %s volumes", pod.Namespace, pod.Name, c.DriverName)
+		return nil
+	}
+
+	if err = c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	return c.restartPod(ctx, pod)
+}
+
+func (c *Controller) namespaceOptedIn(namespace string) (bool, error) {
+	ns, err := c.nsLister.Get(namespace)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return ns.Labels[c.NamespaceLabel] == "true", nil
+}
+
+// usesDriver returns true if pod has any volumes provided by our CSI driver.
+func (c *Controller) usesDriver(pod *corev1.Pod) bool {
+	for i := range pod.Spec.Volumes {
+		vol := &pod.Spec.Volumes[i]
+
+		if vol.CSI != nil && vol.CSI.Driver == c.DriverName {
+			return true
+		}
+
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		pvc, err := c.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName)
+		if err != nil || pvc.Spec.VolumeName == "" {
+			continue
+		}
+
+		pv, err := c.pvLister.Get(pvc.Spec.VolumeName)
+		if err != nil {
+			continue
+		}
+
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == c.DriverName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Controller) restartPod(ctx context.Context, pod *corev1.Pod) error {
+	preconditions := metav1.Preconditions{UID: &pod.UID}
+
+	var err error
+	if c.Evict {
+		log.Infof("Evicting Pod %s/%s", pod.Namespace, pod.Name)
+		err = c.client.CoreV1().Pods(pod.Namespace).EvictV1(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+			DeleteOptions: &metav1.DeleteOptions{
+				Preconditions: &preconditions,
+			},
+		})
+	} else {
+		log.Infof("Deleting Pod %s/%s", pod.Namespace, pod.Name)
+		err = c.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+			Preconditions: &preconditions,
+		})
+	}
+
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		// The Pod is already gone or was replaced.
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,346 @@
+package podrestarter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testDriverName     = "dummy-fuse-csi.cern.ch"
+	testNamespaceLabel = "dummy-fuse-csi.cern.ch/restart-pods"
+)
+
+func newTestController(t *testing.T, evict bool, objs ...runtime.Object) (*Controller, *fake.Clientset) {
+	t.Helper()
+
+	client := fake.NewSimpleClientset(objs...)
+	c := New(client, &Opts{
+		DriverName:     testDriverName,
+		NamespaceLabel: testNamespaceLabel,
+		Evict:          evict,
+		RestartQPS:     1000,
+		RestartBurst:   1000,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		c.queue.ShutDown()
+	})
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		t.Fatal("failed to sync informer caches")
+	}
+
+	// Only restart actions are of interest, drop the informers' list and watch calls.
+	client.ClearActions()
+
+	return c, client
+}
+
+func namespace(name string, optedIn *bool) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if optedIn != nil {
+		ns.Labels = map[string]string{testNamespaceLabel: "false"}
+		if *optedIn {
+			ns.Labels[testNamespaceLabel] = "true"
+		}
+	}
+
+	return ns
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func inlinePod(namespace, name string, uid types.UID) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: uid},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name: "vol",
+				VolumeSource: corev1.VolumeSource{
+					CSI: &corev1.CSIVolumeSource{Driver: testDriverName},
+				},
+			}},
+		},
+	}
+}
+
+func claimPod(namespace, name string, uid types.UID, claimName string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: uid},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name: "vol",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+				},
+			}},
+		},
+	}
+}
+
+func boundClaim(namespace, name, pvName, driver string) (*corev1.PersistentVolumeClaim, *corev1.PersistentVolume) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: pvName},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: pvName},
+			},
+		},
+	}
+
+	return pvc, pv
+}
+
+func healthEvent(kind, namespace, name string, uid types.UID, ts time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name + ".event"},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      kind,
+			Namespace: namespace,
+			Name:      name,
+			UID:       uid,
+		},
+		Type:          corev1.EventTypeWarning,
+		Reason:        volumeConditionAbnormalReason,
+		Message:       "Volume vol: transport endpoint is not connected",
+		LastTimestamp: metav1.NewTime(ts),
+	}
+}
+
+// restartActions returns delete and eviction actions on Pods.
+func restartActions(client *fake.Clientset) []k8stesting.Action {
+	var res []k8stesting.Action
+	for _, a := range client.Actions() {
+		if a.GetResource().Resource != "pods" {
+			continue
+		}
+
+		if a.GetVerb() == "delete" || (a.GetVerb() == "create" && a.GetSubresource() == "eviction") {
+			res = append(res, a)
+		}
+	}
+
+	return res
+}
+
+// queuedRefs drains the work queue.
+func queuedRefs(c *Controller) []podRef {
+	var refs []podRef
+	for c.queue.Len() > 0 {
+		item, _ := c.queue.Get()
+		refs = append(refs, item.(podRef))
+		c.queue.Done(item)
+		c.queue.Forget(item)
+	}
+
+	return refs
+}
+
+func TestNamespaceOptIn(t *testing.T) {
+	testCases := []struct {
+		name        string
+		optedIn     *bool
+		wantRestart bool
+	}{
+		{name: "opted in", optedIn: boolPtr(true), wantRestart: true},
+		{name: "opted out", optedIn: boolPtr(false), wantRestart: false},
+		{name: "no label", optedIn: nil, wantRestart: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, client := newTestController(t, false,
+				namespace("ns", tc.optedIn),
+				inlinePod("ns", "pod", "uid-1"),
+			)
+
+			if err := c.syncPod(context.Background(), podRef{namespace: "ns", name: "pod", uid: "uid-1"}); err != nil {
+				t.Fatalf("syncPod failed: %v", err)
+			}
+
+			if got := len(restartActions(client)) > 0; got != tc.wantRestart {
+				t.Fatalf("restarted=%v, want %v; actions: %v", got, tc.wantRestart, client.Actions())
+			}
+		})
+	}
+}
+
+func TestSkipsPodsWithoutDriverVolumes(t *testing.T) {
+	pvc, pv := boundClaim("ns", "other-claim", "other-pv", "other.csi.example.com")
+	c, client := newTestController(t, false,
+		namespace("ns", boolPtr(true)),
+		claimPod("ns", "pod", "uid-1", "other-claim"),
+		pvc, pv,
+	)
+
+	if err := c.syncPod(context.Background(), podRef{namespace: "ns", name: "pod"}); err != nil {
+		t.Fatalf("syncPod failed: %v", err)
+	}
+
+	if actions := restartActions(client); len(actions) > 0 {
+		t.Fatalf("expected no restarts, got %v", actions)
+	}
+}
+
+func TestPodUIDPrecondition(t *testing.T) {
+	c, client := newTestController(t, false,
+		namespace("ns", boolPtr(true)),
+		inlinePod("ns", "pod", "uid-2"),
+	)
+
+	// The event was reported for a previous instance of the Pod.
+	if err := c.syncPod(context.Background(), podRef{namespace: "ns", name: "pod", uid: "uid-1"}); err != nil {
+		t.Fatalf("syncPod failed: %v", err)
+	}
+
+	if actions := restartActions(client); len(actions) > 0 {
+		t.Fatalf("expected no restarts of a replaced Pod, got %v", actions)
+	}
+
+	if err := c.syncPod(context.Background(), podRef{namespace: "ns", name: "pod", uid: "uid-2"}); err != nil {
+		t.Fatalf("syncPod failed: %v", err)
+	}
+
+	actions := restartActions(client)
+	if len(actions) != 1 {
+		t.Fatalf("expected a single restart, got %v", actions)
+	}
+
+	del, ok := actions[0].(k8stesting.DeleteActionImpl)
+	if !ok {
+		t.Fatalf("expected a delete action, got %#v", actions[0])
+	}
+
+	opts := del.GetDeleteOptions()
+	if opts.Preconditions == nil || opts.Preconditions.UID == nil || *opts.Preconditions.UID != "uid-2" {
+		t.Fatalf("expected delete with UID precondition uid-2, got %+v", opts.Preconditions)
+	}
+}
+
+func TestDeleteVsEvict(t *testing.T) {
+	testCases := []struct {
+		name            string
+		evict           bool
+		wantVerb        string
+		wantSubresource string
+	}{
+		{name: "delete", evict: false, wantVerb: "delete", wantSubresource: ""},
+		{name: "evict", evict: true, wantVerb: "create", wantSubresource: "eviction"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, client := newTestController(t, tc.evict,
+				namespace("ns", boolPtr(true)),
+				inlinePod("ns", "pod", "uid-1"),
+			)
+
+			if err := c.syncPod(context.Background(), podRef{namespace: "ns", name: "pod", uid: "uid-1"}); err != nil {
+				t.Fatalf("syncPod failed: %v", err)
+			}
+
+			actions := restartActions(client)
+			if len(actions) != 1 {
+				t.Fatalf("expected a single restart, got %v", actions)
+			}
+
+			a := actions[0]
+			if a.GetVerb() != tc.wantVerb || a.GetSubresource() != tc.wantSubresource {
+				t.Fatalf("got %s %s/%s, want %s %s", a.GetVerb(), a.GetResource().Resource, a.GetSubresource(),
+					tc.wantVerb, tc.wantSubresource)
+			}
+
+			if tc.evict {
+				ev, ok := a.(k8stesting.CreateActionImpl).GetObject().(*policyv1.Eviction)
+				if !ok {
+					t.Fatalf("expected an Eviction object, got %#v", a)
+				}
+
+				if ev.Name != "pod" || ev.Namespace != "ns" {
+					t.Fatalf("eviction of wrong Pod %s/%s", ev.Namespace, ev.Name)
+				}
+
+				if ev.DeleteOptions == nil || ev.DeleteOptions.Preconditions == nil ||
+					ev.DeleteOptions.Preconditions.UID == nil || *ev.DeleteOptions.Preconditions.UID != "uid-1" {
+					t.Fatalf("expected eviction with UID precondition uid-1, got %+v", ev.DeleteOptions)
+				}
+			}
+		})
+	}
+}
+
+func TestPVCEventResolvesPods(t *testing.T) {
+	pvc, pv := boundClaim("ns", "claim", "pv", testDriverName)
+	c, _ := newTestController(t, false,
+		namespace("ns", boolPtr(true)),
+		claimPod("ns", "pod-a", "uid-a", "claim"),
+		claimPod("ns", "pod-b", "uid-b", "claim"),
+		claimPod("ns", "pod-c", "uid-c", "other-claim"),
+		pvc, pv,
+	)
+
+	c.onEvent(healthEvent("PersistentVolumeClaim", "ns", "claim", "", time.Now().Add(time.Minute)))
+
+	refs := queuedRefs(c)
+	got := make(map[string]bool)
+	for _, ref := range refs {
+		if ref.uid != "" {
+			t.Errorf("expected no UID for Pods found through a PVC, got %q for %s", ref.uid, ref.name)
+		}
+		got[ref.namespace+"/"+ref.name] = true
+	}
+
+	if len(got) != 2 || !got["ns/pod-a"] || !got["ns/pod-b"] {
+		t.Fatalf("expected ns/pod-a and ns/pod-b to be queued, got %v", refs)
+	}
+}
+
+func TestPodEventIsQueuedWithUID(t *testing.T) {
+	c, _ := newTestController(t, false, namespace("ns", boolPtr(true)))
+
+	c.onEvent(healthEvent("Pod", "ns", "pod", "uid-1", time.Now().Add(time.Minute)))
+
+	refs := queuedRefs(c)
+	want := podRef{namespace: "ns", name: "pod", uid: "uid-1"}
+	if len(refs) != 1 || refs[0] != want {
+		t.Fatalf("expected %+v to be queued, got %v", want, refs)
+	}
+}
+
+func TestIgnoresOldAndUnrelatedEvents(t *testing.T) {
+	c, _ := newTestController(t, false, namespace("ns", boolPtr(true)))
+
+	// Reported before the controller started.
+	c.onEvent(healthEvent("Pod", "ns", "old-pod", "uid-1", c.startTime.Add(-time.Minute)))
+
+	// Not a volume health event.
+	ev := healthEvent("Pod", "ns", "normal-pod", "uid-2", time.Now().Add(time.Minute))
+	ev.Type = corev1.EventTypeNormal
+	c.onEvent(ev)
+
+	ev = healthEvent("Pod", "ns", "other-pod", "uid-3", time.Now().Add(time.Minute))
+	ev.Reason = "FailedMount"
+	ev.Message = "some other error"
+	c.onEvent(ev)
+
+	if refs := queuedRefs(c); len(refs) > 0 {
+		t.Fatalf("expected nothing to be queued, got %v", refs)
+	}
+}
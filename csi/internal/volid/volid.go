@@ -0,0 +1,14 @@
+package volid
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Escape returns volID in a form that's safe to use as a file name.
+// Volume IDs may contain slashes, dots and other characters that are
+// not safe to use in a file name as-is. Escaped IDs are stored on disk,
+// e.g. as names of mount cache entries, so the encoding must not change.
+func Escape(volID string) string {
+	return strings.ReplaceAll(url.PathEscape(volID), ".", "%2E")
+}
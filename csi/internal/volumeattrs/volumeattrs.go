@@ -0,0 +1,213 @@
+package volumeattrs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Volume attributes are passed to the driver in the volume context of a PV
+// (PersistentVolume.spec.csi.volumeAttributes, or StorageClass parameters
+// of dynamically provisioned volumes). Supported attributes are declared
+// in Schema, and parsed into a typed Config.
+
+type (
+	// Type of an attribute value.
+	Type int
+
+	// Attr declares a supported volume attribute.
+	Attr struct {
+		Key  string
+		Type Type
+		// Default value used when the attribute is not set.
+		Default string
+		// Allowed values of TypeEnum attributes.
+		Allowed []string
+		// Description is a human readable description of the attribute.
+		Description string
+
+		// set stores the parsed value in Config.
+		set func(c *Config, v string)
+	}
+
+	// PublishMode is the way a staged volume is published into its target path.
+	PublishMode string
+
+	// Config is a parsed per-volume configuration.
+	Config struct {
+		// PublishMode is the way a staged volume is published into its target path.
+		PublishMode PublishMode
+
+		// HealthCheck enables health monitoring of the volume's mounts.
+		HealthCheck bool
+
+		// RestoreMount enables storing the volume's mount instructions
+		// in the mount cache, so that it's remounted after node plugin restart.
+		RestoreMount bool
+	}
+)
+
+const (
+	TypeBool Type = iota
+	TypeEnum
+)
+
+const (
+	// PublishModeBind publishes the volume with a plain bind mount.
+	PublishModeBind PublishMode = "bind"
+	// PublishModeRbindSlave publishes the volume with a recursive bind mount,
+	// with one-way mount propagation from the staging path.
+	PublishModeRbindSlave PublishMode = "rbind-slave"
+)
+
+const (
+	KeyPublishMode  = "publishMode"
+	KeyHealthCheck  = "healthCheck"
+	KeyRestoreMount = "restoreMount"
+)
+
+// Schema of supported volume attributes.
+var Schema = []Attr{
+	{
+		Key:         KeyPublishMode,
+		Type:        TypeEnum,
+		Default:     string(PublishModeBind),
+		Allowed:     []string{string(PublishModeBind), string(PublishModeRbindSlave)},
+		Description: "How is the staged volume published into the target path.",
+		set:         func(c *Config, v string) { c.PublishMode = PublishMode(v) },
+	},
+	{
+		Key:         KeyHealthCheck,
+		Type:        TypeBool,
+		Default:     "true",
+		Description: "Whether the health monitor checks the volume's mounts.",
+		set:         func(c *Config, v string) { c.HealthCheck, _ = strconv.ParseBool(v) },
+	},
+	{
+		Key:         KeyRestoreMount,
+		Type:        TypeBool,
+		Default:     "true",
+		Description: "Whether the volume is remounted after node plugin restart, when --restore-mounts is enabled.",
+		set:         func(c *Config, v string) { c.RestoreMount, _ = strconv.ParseBool(v) },
+	},
+}
+
+// Attributes with these prefixes are set by Kubernetes components (e.g. by kubelet
+// with podInfoOnMount, or by external-provisioner) and are always accepted.
+var reservedPrefixes = []string{
+	"csi.storage.k8s.io/",
+	"storage.kubernetes.io/",
+}
+
+func (t Type) String() string {
+	switch t {
+	case TypeBool:
+		return "bool"
+	case TypeEnum:
+		return "enum"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+func (a *Attr) validate(v string) error {
+	switch a.Type {
+	case TypeBool:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("volume attribute %s must be a boolean, got %q", a.Key, v)
+		}
+	case TypeEnum:
+		for _, allowed := range a.Allowed {
+			if v == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("volume attribute %s must be one of %s, got %q",
+			a.Key, strings.Join(a.Allowed, ", "), v)
+	}
+
+	return nil
+}
+
+func isReserved(key string) bool {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keys returns sorted keys of all supported volume attributes.
+func Keys() []string {
+	keys := make([]string, len(Schema))
+	for i := range Schema {
+		keys[i] = Schema[i].Key
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Parse validates volume attributes against Schema and returns the parsed
+// volume configuration. Attributes that are not set take their default values.
+// Unknown attributes are rejected if strict is true, otherwise they are returned
+// in unknownKeys so that the caller may report them.
+func Parse(attrs map[string]string, strict bool) (cfg *Config, unknownKeys []string, err error) {
+	for k := range attrs {
+		if isReserved(k) || lookup(k) != nil {
+			continue
+		}
+
+		unknownKeys = append(unknownKeys, k)
+	}
+
+	sort.Strings(unknownKeys)
+
+	if strict && len(unknownKeys) > 0 {
+		return nil, unknownKeys, fmt.Errorf("unknown volume attributes %s, supported attributes are %s",
+			strings.Join(unknownKeys, ", "), strings.Join(Keys(), ", "))
+	}
+
+	cfg = &Config{}
+
+	for i := range Schema {
+		a := &Schema[i]
+
+		v, ok := attrs[a.Key]
+		if !ok {
+			v = a.Default
+		}
+
+		if err := a.validate(v); err != nil {
+			return nil, unknownKeys, err
+		}
+
+		a.set(cfg, v)
+	}
+
+	return cfg, unknownKeys, nil
+}
+
+// Default returns volume configuration with all attributes set to their default values.
+func Default() *Config {
+	cfg, _, err := Parse(nil, true)
+	if err != nil {
+		panic(fmt.Sprintf("invalid volume attribute defaults: %v", err))
+	}
+
+	return cfg
+}
+
+func lookup(key string) *Attr {
+	for i := range Schema {
+		if Schema[i].Key == key {
+			return &Schema[i]
+		}
+	}
+
+	return nil
+}
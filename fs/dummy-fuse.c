@@ -1,18 +1,39 @@
 #define FUSE_USE_VERSION 37
 
 #include <assert.h>
+#include <dirent.h>
 #include <errno.h>
 #include <fcntl.h>
 #include <fuse.h>
 #include <stddef.h>
 #include <stdio.h>
+#include <stdlib.h>
 #include <string.h>
+#include <sys/stat.h>
+#include <sys/statvfs.h>
+#include <unistd.h>
 
 extern const char *dummy_version;
 
 const char *dummy_filename = "dummy-file.txt";
 const char *dummy_file_contents = "Hello world!\n";
 
+static struct options {
+  // If set, the filesystem is writable and its contents
+  // are stored in this directory.
+  const char *backing_dir;
+} options;
+
+#define OPTION(t, p) {t, offsetof(struct options, p), 1}
+
+static const struct fuse_opt option_spec[] = {
+  OPTION("backing_dir=%s", backing_dir),
+  FUSE_OPT_END
+};
+
+// File descriptor of the backing directory.
+static int backing_fd = -1;
+
 static void *dummy_init(struct fuse_conn_info *conn, struct fuse_config *cfg) {
   (void)conn;
   cfg->kernel_cache = 1;
@@ -92,6 +113,242 @@ static const struct fuse_operations dummy_ops = {
   .read    = dummy_read,
 };
 
+/*
+ * Writable mode. All operations are passed through to the backing
+ * directory, paths are resolved relative to backing_fd.
+ */
+
+static const char *backing_path(const char *path) {
+  return strcmp(path, "/") == 0 ? "." : path + 1;
+}
+
+static void *backing_init(struct fuse_conn_info *conn,
+                          struct fuse_config *cfg) {
+  (void)conn;
+  // File contents may change, don't let the kernel cache them.
+  cfg->kernel_cache = 0;
+  cfg->use_ino = 1;
+  return NULL;
+}
+
+static int backing_getattr(const char *path, struct stat *stbuf,
+                           struct fuse_file_info *fi) {
+  int res;
+
+  if (fi != NULL)
+    res = fstat(fi->fh, stbuf);
+  else
+    res = fstatat(backing_fd, backing_path(path), stbuf, AT_SYMLINK_NOFOLLOW);
+
+  return res == -1 ? -errno : 0;
+}
+
+static int backing_readdir(const char *path, void *buf, fuse_fill_dir_t filler,
+                           off_t offset, struct fuse_file_info *fi,
+                           enum fuse_readdir_flags flags) {
+  (void)offset;
+  (void)fi;
+  (void)flags;
+
+  int fd = openat(backing_fd, backing_path(path), O_RDONLY | O_DIRECTORY);
+  if (fd == -1)
+    return -errno;
+
+  DIR *dp = fdopendir(fd);
+  if (dp == NULL) {
+    int err = errno;
+    close(fd);
+    return -err;
+  }
+
+  struct dirent *de;
+  while ((de = readdir(dp)) != NULL) {
+    struct stat st;
+    memset(&st, 0, sizeof(st));
+    st.st_ino = de->d_ino;
+    st.st_mode = de->d_type << 12;
+    if (filler(buf, de->d_name, &st, 0, 0))
+      break;
+  }
+
+  closedir(dp);
+  return 0;
+}
+
+static int backing_open(const char *path, struct fuse_file_info *fi) {
+  int fd = openat(backing_fd, backing_path(path), fi->flags & ~O_NOFOLLOW);
+  if (fd == -1)
+    return -errno;
+
+  fi->fh = fd;
+  return 0;
+}
+
+static int backing_create(const char *path, mode_t mode,
+                          struct fuse_file_info *fi) {
+  int fd = openat(backing_fd, backing_path(path), fi->flags, mode);
+  if (fd == -1)
+    return -errno;
+
+  fi->fh = fd;
+  return 0;
+}
+
+static int backing_read(const char *path, char *buf, size_t size, off_t offset,
+                        struct fuse_file_info *fi) {
+  (void)path;
+  ssize_t res = pread(fi->fh, buf, size, offset);
+  return res == -1 ? -errno : res;
+}
+
+static int backing_write(const char *path, const char *buf, size_t size,
+                         off_t offset, struct fuse_file_info *fi) {
+  (void)path;
+  ssize_t res = pwrite(fi->fh, buf, size, offset);
+  return res == -1 ? -errno : res;
+}
+
+static int backing_release(const char *path, struct fuse_file_info *fi) {
+  (void)path;
+  close(fi->fh);
+  return 0;
+}
+
+static int backing_fsync(const char *path, int isdatasync,
+                         struct fuse_file_info *fi) {
+  (void)path;
+  int res = isdatasync ? fdatasync(fi->fh) : fsync(fi->fh);
+  return res == -1 ? -errno : 0;
+}
+
+static int backing_truncate(const char *path, off_t size,
+                            struct fuse_file_info *fi) {
+  int res;
+
+  if (fi != NULL) {
+    res = ftruncate(fi->fh, size);
+  } else {
+    int fd = openat(backing_fd, backing_path(path), O_WRONLY);
+    if (fd == -1)
+      return -errno;
+    res = ftruncate(fd, size);
+    if (res == -1) {
+      int err = errno;
+      close(fd);
+      return -err;
+    }
+    close(fd);
+  }
+
+  return res == -1 ? -errno : 0;
+}
+
+static int backing_mkdir(const char *path, mode_t mode) {
+  return mkdirat(backing_fd, backing_path(path), mode) == -1 ? -errno : 0;
+}
+
+static int backing_unlink(const char *path) {
+  return unlinkat(backing_fd, backing_path(path), 0) == -1 ? -errno : 0;
+}
+
+static int backing_rmdir(const char *path) {
+  return unlinkat(backing_fd, backing_path(path), AT_REMOVEDIR) == -1 ? -errno
+                                                                       : 0;
+}
+
+static int backing_rename(const char *from, const char *to,
+                          unsigned int flags) {
+  if (flags)
+    return -EINVAL;
+
+  return renameat(backing_fd, backing_path(from), backing_fd,
+                  backing_path(to)) == -1
+             ? -errno
+             : 0;
+}
+
+static int backing_chmod(const char *path, mode_t mode,
+                         struct fuse_file_info *fi) {
+  int res;
+
+  if (fi != NULL)
+    res = fchmod(fi->fh, mode);
+  else
+    res = fchmodat(backing_fd, backing_path(path), mode, 0);
+
+  return res == -1 ? -errno : 0;
+}
+
+static int backing_utimens(const char *path, const struct timespec ts[2],
+                           struct fuse_file_info *fi) {
+  int res;
+
+  if (fi != NULL)
+    res = futimens(fi->fh, ts);
+  else
+    res = utimensat(backing_fd, backing_path(path), ts, AT_SYMLINK_NOFOLLOW);
+
+  return res == -1 ? -errno : 0;
+}
+
+static int backing_statfs(const char *path, struct statvfs *stbuf) {
+  (void)path;
+  return fstatvfs(backing_fd, stbuf) == -1 ? -errno : 0;
+}
+
+static const struct fuse_operations backing_ops = {
+  .init     = backing_init,
+  .getattr  = backing_getattr,
+  .readdir  = backing_readdir,
+  .open     = backing_open,
+  .create   = backing_create,
+  .read     = backing_read,
+  .write    = backing_write,
+  .release  = backing_release,
+  .fsync    = backing_fsync,
+  .truncate = backing_truncate,
+  .mkdir    = backing_mkdir,
+  .unlink   = backing_unlink,
+  .rmdir    = backing_rmdir,
+  .rename   = backing_rename,
+  .chmod    = backing_chmod,
+  .utimens  = backing_utimens,
+  .statfs   = backing_statfs,
+};
+
+// Opens the backing directory and populates it with the dummy file,
+// unless it already exists.
+static int setup_backing_dir(const char *dir) {
+  backing_fd = open(dir, O_RDONLY | O_DIRECTORY);
+  if (backing_fd == -1) {
+    fprintf(stderr, "failed to open backing directory %s: %s\n", dir,
+            strerror(errno));
+    return -1;
+  }
+
+  int fd = openat(backing_fd, dummy_filename, O_WRONLY | O_CREAT | O_EXCL,
+                  0644);
+  if (fd == -1) {
+    if (errno == EEXIST)
+      return 0;
+
+    fprintf(stderr, "failed to create %s in backing directory %s: %s\n",
+            dummy_filename, dir, strerror(errno));
+    return -1;
+  }
+
+  size_t len = strlen(dummy_file_contents);
+  if (write(fd, dummy_file_contents, len) != (ssize_t)len) {
+    fprintf(stderr, "failed to write %s in backing directory %s\n",
+            dummy_filename, dir);
+    close(fd);
+    return -1;
+  }
+
+  close(fd);
+  return 0;
+}
+
 int main(int argc, char *argv[]) {
   for (int i = 0; i < argc; i++) {
     if (strcmp(argv[i], "--version") == 0) {
@@ -103,7 +360,18 @@ int main(int argc, char *argv[]) {
   int ret;
   struct fuse_args args = FUSE_ARGS_INIT(argc, argv);
 
-  ret = fuse_main(args.argc, args.argv, &dummy_ops, NULL);
+  if (fuse_opt_parse(&args, &options, option_spec, NULL) == -1)
+    return 1;
+
+  if (options.backing_dir != NULL) {
+    if (setup_backing_dir(options.backing_dir) != 0)
+      return 1;
+
+    ret = fuse_main(args.argc, args.argv, &backing_ops, NULL);
+  } else {
+    ret = fuse_main(args.argc, args.argv, &dummy_ops, NULL);
+  }
+
   fuse_opt_free_args(&args);
   return ret;
 }